@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server/tcp"
+)
+
+//duration 支持在配置文件中使用 "3s" 这种格式
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(value)
+	return nil
+}
+
+//config 启动配置，可以来自配置文件，命令行参数会覆盖配置文件中的值
+type config struct {
+	//Listen 对用户提供服务的地址
+	Listen string `json:"listen"`
+	//MetricsListen 提供Prometheus metrics（/metrics）的HTTP地址，为空时不提供
+	MetricsListen string `json:"metrics_listen"`
+	//Backend 后端server地址，多个后端用逗号分隔
+	Backend string `json:"backend"`
+	//Balancer 多个后端时的负载均衡策略
+	Balancer string `json:"balancer"`
+	//MaxClientsPerBackend 到每个后端的最大连接数，0表示只受MaxClients限制
+	MaxClientsPerBackend int `json:"max_clients_per_backend"`
+	//Codec 与后端之间的报文格式，需要已经通过proxy.RegisterCodec注册
+	Codec string `json:"codec"`
+	//MaxClients 到后端的最大连接数
+	MaxClients int `json:"max_clients"`
+	//ConnectTimeout 连接后端的超时时间
+	ConnectTimeout duration `json:"connect_timeout"`
+	//KeepAlive 后端连接的keepalive间隔
+	KeepAlive duration `json:"keepalive"`
+	//ReadTimeout 读后端的超时时间
+	ReadTimeout duration `json:"read_timeout"`
+	//WriteTimeout 写后端的超时时间
+	WriteTimeout duration `json:"write_timeout"`
+	//MaxFrameSize 后端返回的一帧的最大字节数
+	MaxFrameSize int `json:"max_frame_size"`
+	//StreamLargeFrames 超过MaxFrameSize的帧分块转发，而不是断开连接
+	StreamLargeFrames bool `json:"stream_large_frames"`
+	//DrainTimeout 用户中途断开时，清空后端未读报文的超时时间
+	DrainTimeout duration `json:"drain_timeout"`
+	//DrainLimit 用户中途断开时，最多清空的后端报文字节数
+	DrainLimit int `json:"drain_limit"`
+	//MaxIdleTime 后端连接空闲超过这个时间后关闭，0表示不限制
+	MaxIdleTime duration `json:"max_idle_time"`
+	//MaxLifetime 后端连接建立超过这个时间后不再复用，0表示不限制
+	MaxLifetime duration `json:"max_lifetime"`
+	//MaxIdleConns 最多保留的空闲后端连接数，0表示不限制
+	MaxIdleConns int `json:"max_idle_conns"`
+	//MinIdle 启动时预先建立、并在后台保持的空闲后端连接数
+	MinIdle int `json:"min_idle"`
+	//HealthCheckQuery 空闲后端连接的探测请求，为空时不检查
+	HealthCheckQuery string `json:"health_check_query"`
+	//HealthCheckInterval 空闲后端连接的检查间隔
+	HealthCheckInterval duration `json:"health_check_interval"`
+	//HealthCheckTimeout 探测的延迟上限，超过后关闭连接
+	HealthCheckTimeout duration `json:"health_check_timeout"`
+	//ValidateOnBorrow 取出空闲后端连接时先检查连接是否可用
+	ValidateOnBorrow bool `json:"validate_on_borrow"`
+	//ValidateWindow 上一次使用在这个时间之内的连接不检查
+	ValidateWindow duration `json:"validate_window"`
+	//RetryAttempts 请求没有发送成功或者在第一帧之前失败时最多尝试的次数，包括第一次
+	RetryAttempts int `json:"retry_attempts"`
+	//RetryBackoff 第一次重试之前的等待时间，之后每次翻倍
+	RetryBackoff duration `json:"retry_backoff"`
+	//RetryBudget 每个请求可以增加的重试次数比例，0表示不限制
+	RetryBudget float64 `json:"retry_budget"`
+	//OutlierConsecutiveErrors 后端连续失败这么多次后被摘除，0表示不摘除
+	OutlierConsecutiveErrors int `json:"outlier_consecutive_errors"`
+	//OutlierEjectionTime 第一次摘除的时间，之后每次翻倍
+	OutlierEjectionTime duration `json:"outlier_ejection_time"`
+	//CircuitFailureThreshold 后端连续失败这么多次后熔断，0表示不熔断
+	CircuitFailureThreshold int `json:"circuit_failure_threshold"`
+	//CircuitOpenTimeout 熔断多久后放行试探请求
+	CircuitOpenTimeout duration `json:"circuit_open_timeout"`
+	//SlowResponse response超过这个时间输出慢日志，0表示不输出
+	SlowResponse duration `json:"slow_response"`
+}
+
+func defaultConfig() config {
+	return config{
+		Listen:         ":6000",
+		Codec:          proxy.DefaultCodecName,
+		Balancer:       proxy.RoundRobinBalancerName,
+		MaxClients:     64,
+		ConnectTimeout: duration(tcp.DefaultConnectTimeout),
+		KeepAlive:      duration(tcp.DefaultKeepAlive),
+		MaxFrameSize:   proxy.MaxProtocolLength,
+		DrainTimeout:   duration(5 * time.Second),
+		DrainLimit:     1 << 20,
+	}
+}
+
+//loadConfig 从json文件中加载配置，没有配置的项保持原值
+func loadConfig(path string, c *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, c)
+}
+
+//parseConfig 解析命令行参数；如果指定了-config，先加载配置文件，然后用显式指定的命令行参数覆盖
+func parseConfig(args []string) (config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("simple-tcp-proxy", flag.ContinueOnError)
+	path := fs.String("config", "", "json config file")
+	listen := fs.String("listen", c.Listen, "address to accept user connections")
+	metricsListen := fs.String("metrics-listen", c.MetricsListen, "http address to serve prometheus metrics on /metrics, empty to disable")
+	backend := fs.String("backend", c.Backend, "backend server addresses, separated by comma")
+	balancer := fs.String("balancer", c.Balancer, "load balancing strategy among backends: round-robin, least-in-use, p2c or consistent-hash")
+	maxClientsPerBackend := fs.Int("max-clients-per-backend", c.MaxClientsPerBackend, "max connections to each backend, 0 means only max-clients applies")
+	codec := fs.String("codec", c.Codec, "backend frame codec")
+	maxClients := fs.Int("max-clients", c.MaxClients, "max connections to backend")
+	connectTimeout := fs.Duration("connect-timeout", time.Duration(c.ConnectTimeout), "backend connect timeout")
+	keepAlive := fs.Duration("keepalive", time.Duration(c.KeepAlive), "backend tcp keepalive period, negative to disable")
+	readTimeout := fs.Duration("read-timeout", time.Duration(c.ReadTimeout), "backend read timeout, 0 means no timeout")
+	writeTimeout := fs.Duration("write-timeout", time.Duration(c.WriteTimeout), "backend write timeout, 0 means no timeout")
+	maxFrameSize := fs.Int("max-frame-size", c.MaxFrameSize, "max bytes of a backend frame")
+	streamLargeFrames := fs.Bool("stream-large-frames", c.StreamLargeFrames, "relay frames larger than max-frame-size in chunks instead of failing")
+	drainTimeout := fs.Duration("drain-timeout", time.Duration(c.DrainTimeout), "timeout to drain an abandoned response, 0 means no timeout")
+	drainLimit := fs.Int("drain-limit", c.DrainLimit, "max bytes to drain from an abandoned response, 0 means no limit")
+	maxIdleTime := fs.Duration("max-idle-time", time.Duration(c.MaxIdleTime), "close backend connections idle for longer, 0 means no limit")
+	maxLifetime := fs.Duration("max-lifetime", time.Duration(c.MaxLifetime), "stop reusing backend connections older than this, 0 means no limit")
+	maxIdleConns := fs.Int("max-idle-conns", c.MaxIdleConns, "max idle backend connections to keep, 0 means no limit")
+	minIdle := fs.Int("min-idle", c.MinIdle, "idle backend connections to dial at startup and keep in background")
+	healthCheckQuery := fs.String("health-check-query", c.HealthCheckQuery, "probe query sent on idle backend connections, empty to disable")
+	healthCheckInterval := fs.Duration("health-check-interval", time.Duration(c.HealthCheckInterval), "interval of probing idle backend connections")
+	healthCheckTimeout := fs.Duration("health-check-timeout", time.Duration(c.HealthCheckTimeout), "close backend connections whose probe is slower, 0 means no limit")
+	validateOnBorrow := fs.Bool("validate-on-borrow", c.ValidateOnBorrow, "check idle backend connections are alive before reusing them")
+	validateWindow := fs.Duration("validate-window", time.Duration(c.ValidateWindow), "skip checking backend connections used within this window")
+	retryAttempts := fs.Int("retry-attempts", c.RetryAttempts, "max attempts of a request failed before the first frame, including the first one")
+	retryBackoff := fs.Duration("retry-backoff", time.Duration(c.RetryBackoff), "backoff before the first retry, doubled for each retry")
+	retryBudget := fs.Float64("retry-budget", c.RetryBudget, "ratio of retries to requests, 0 means no limit")
+	outlierConsecutiveErrors := fs.Int("outlier-consecutive-errors", c.OutlierConsecutiveErrors, "eject a backend after this many consecutive failures, 0 means never")
+	outlierEjectionTime := fs.Duration("outlier-ejection-time", time.Duration(c.OutlierEjectionTime), "time of the first ejection, doubled for each ejection in a row")
+	circuitFailureThreshold := fs.Int("circuit-failure-threshold", c.CircuitFailureThreshold, "open the circuit of a backend after this many consecutive failures, 0 means never")
+	circuitOpenTimeout := fs.Duration("circuit-open-timeout", time.Duration(c.CircuitOpenTimeout), "let a trial request through after the circuit has been open for this long")
+	slowResponse := fs.Duration("slow-response", time.Duration(c.SlowResponse), "log responses slower than this, 0 means never")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		if err := loadConfig(*path, &c); err != nil {
+			return c, err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = *listen
+		case "metrics-listen":
+			c.MetricsListen = *metricsListen
+		case "backend":
+			c.Backend = *backend
+		case "balancer":
+			c.Balancer = *balancer
+		case "max-clients-per-backend":
+			c.MaxClientsPerBackend = *maxClientsPerBackend
+		case "codec":
+			c.Codec = *codec
+		case "max-clients":
+			c.MaxClients = *maxClients
+		case "connect-timeout":
+			c.ConnectTimeout = duration(*connectTimeout)
+		case "keepalive":
+			c.KeepAlive = duration(*keepAlive)
+		case "read-timeout":
+			c.ReadTimeout = duration(*readTimeout)
+		case "write-timeout":
+			c.WriteTimeout = duration(*writeTimeout)
+		case "max-frame-size":
+			c.MaxFrameSize = *maxFrameSize
+		case "stream-large-frames":
+			c.StreamLargeFrames = *streamLargeFrames
+		case "drain-timeout":
+			c.DrainTimeout = duration(*drainTimeout)
+		case "drain-limit":
+			c.DrainLimit = *drainLimit
+		case "max-idle-time":
+			c.MaxIdleTime = duration(*maxIdleTime)
+		case "max-lifetime":
+			c.MaxLifetime = duration(*maxLifetime)
+		case "max-idle-conns":
+			c.MaxIdleConns = *maxIdleConns
+		case "min-idle":
+			c.MinIdle = *minIdle
+		case "health-check-query":
+			c.HealthCheckQuery = *healthCheckQuery
+		case "health-check-interval":
+			c.HealthCheckInterval = duration(*healthCheckInterval)
+		case "health-check-timeout":
+			c.HealthCheckTimeout = duration(*healthCheckTimeout)
+		case "validate-on-borrow":
+			c.ValidateOnBorrow = *validateOnBorrow
+		case "validate-window":
+			c.ValidateWindow = duration(*validateWindow)
+		case "retry-attempts":
+			c.RetryAttempts = *retryAttempts
+		case "retry-backoff":
+			c.RetryBackoff = duration(*retryBackoff)
+		case "retry-budget":
+			c.RetryBudget = *retryBudget
+		case "outlier-consecutive-errors":
+			c.OutlierConsecutiveErrors = *outlierConsecutiveErrors
+		case "outlier-ejection-time":
+			c.OutlierEjectionTime = duration(*outlierEjectionTime)
+		case "circuit-failure-threshold":
+			c.CircuitFailureThreshold = *circuitFailureThreshold
+		case "circuit-open-timeout":
+			c.CircuitOpenTimeout = duration(*circuitOpenTimeout)
+		case "slow-response":
+			c.SlowResponse = duration(*slowResponse)
+		}
+	})
+	return c, c.validate()
+}
+
+func (c config) validate() error {
+	if len(c.backendAddrs()) == 0 {
+		return errors.New("backend address is required")
+	}
+	if _, exists := proxy.GetBalancer(c.Balancer); !exists {
+		return errors.New("unknown balancer " + c.Balancer)
+	}
+	if c.MaxClientsPerBackend < 0 {
+		return errors.New("max clients per backend should not be negative")
+	}
+	if _, exists := proxy.GetCodec(c.Codec); !exists {
+		return errors.New("unknown codec " + c.Codec)
+	}
+	if c.MaxClients <= 0 {
+		return errors.New("max clients should be positive")
+	}
+	if c.MaxFrameSize <= 0 {
+		return errors.New("max frame size should be positive")
+	}
+	if c.MaxIdleTime < 0 || c.MaxLifetime < 0 || c.MaxIdleConns < 0 || c.MinIdle < 0 {
+		return errors.New("max idle time, max lifetime, max idle conns and min idle should not be negative")
+	}
+	if c.OutlierConsecutiveErrors < 0 || c.OutlierEjectionTime < 0 {
+		return errors.New("outlier consecutive errors and ejection time should not be negative")
+	}
+	if c.CircuitFailureThreshold < 0 || c.CircuitOpenTimeout < 0 {
+		return errors.New("circuit failure threshold and open timeout should not be negative")
+	}
+	if c.HealthCheckQuery != "" {
+		codec, _ := proxy.GetCodec(c.Codec)
+		if err := codec.ValidateRequest([]byte(c.HealthCheckQuery)); err != nil {
+			return errors.New("bad health check query: " + err.Error())
+		}
+		if c.HealthCheckInterval <= 0 {
+			return errors.New("health check interval should be positive")
+		}
+	}
+	return nil
+}
+
+//proxyOptions proxy的配置
+func (c config) proxyOptions() []proxy.Option {
+	codec, _ := proxy.GetCodec(c.Codec)
+	balancer, _ := proxy.GetBalancer(c.Balancer)
+	opts := []proxy.Option{
+		proxy.WithCodec(codec),
+		proxy.WithBalancer(balancer),
+		proxy.WithMaxFrameSize(c.MaxFrameSize),
+		proxy.WithDrainTimeout(time.Duration(c.DrainTimeout)),
+		proxy.WithDrainLimit(c.DrainLimit),
+		proxy.WithMaxIdleTime(time.Duration(c.MaxIdleTime)),
+		proxy.WithMaxLifetime(time.Duration(c.MaxLifetime)),
+		proxy.WithMaxIdleConns(c.MaxIdleConns),
+		proxy.WithMinIdle(c.MinIdle),
+		proxy.WithLogger(proxy.NewStdLogger(nil, proxy.LevelInfo)),
+		proxy.WithSlowResponseThreshold(time.Duration(c.SlowResponse)),
+	}
+	if c.HealthCheckQuery != "" {
+		opts = append(opts, proxy.WithHealthCheck(proxy.HealthCheckConfig{
+			Query:    []byte(c.HealthCheckQuery),
+			Interval: time.Duration(c.HealthCheckInterval),
+			Timeout:  time.Duration(c.HealthCheckTimeout),
+		}))
+	}
+	if c.ValidateOnBorrow {
+		opts = append(opts, proxy.WithValidation(proxy.ValidationConfig{Window: time.Duration(c.ValidateWindow)}))
+	}
+	if c.RetryAttempts > 1 {
+		opts = append(opts, proxy.WithRetry(proxy.RetryPolicy{
+			MaxAttempts: c.RetryAttempts,
+			Backoff:     time.Duration(c.RetryBackoff),
+			MaxBackoff:  time.Second,
+			Jitter:      0.2,
+			Budget:      c.RetryBudget,
+		}))
+	}
+	if c.OutlierConsecutiveErrors > 0 {
+		outlier := proxy.OutlierDetection{
+			ConsecutiveErrors: c.OutlierConsecutiveErrors,
+			BaseEjectionTime:  time.Duration(c.OutlierEjectionTime),
+		}
+		if c.HealthCheckQuery != "" {
+			outlier.Query = []byte(c.HealthCheckQuery)
+		}
+		opts = append(opts, proxy.WithOutlierDetection(outlier))
+	}
+	if c.CircuitFailureThreshold > 0 {
+		opts = append(opts, proxy.WithCircuitBreaker(proxy.CircuitBreaker{
+			FailureThreshold: c.CircuitFailureThreshold,
+			OpenTimeout:      time.Duration(c.CircuitOpenTimeout),
+		}))
+	}
+	if c.StreamLargeFrames {
+		opts = append(opts, proxy.WithLargeFrameStreaming())
+	}
+	return opts
+}
+
+//backendAddrs 所有后端的地址
+func (c config) backendAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.Backend, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+//backends 每个后端一个TCP server
+func (c config) backends() []proxy.Backend {
+	var backends []proxy.Backend
+	for _, addr := range c.backendAddrs() {
+		backends = append(backends, proxy.Backend{Server: tcp.NewServer(c.tcpConfig(addr)), MaxClient: c.MaxClientsPerBackend})
+	}
+	return backends
+}
+
+//tcpConfig 到addr的后端连接配置
+func (c config) tcpConfig(addr string) tcp.Config {
+	return tcp.Config{
+		Addr:           addr,
+		ConnectTimeout: time.Duration(c.ConnectTimeout),
+		KeepAlive:      time.Duration(c.KeepAlive),
+		NoDelay:        true,
+		ReadTimeout:    time.Duration(c.ReadTimeout),
+		WriteTimeout:   time.Duration(c.WriteTimeout),
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+func main() {
+	c, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("bad config: %v", err)
+	}
+
+	p := proxy.NewMultiProxy(c.MaxClients, c.backends(), c.proxyOptions()...)
+	frontend := proxy.NewFrontend(p)
+
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		log.Fatalf("listen on %s failed: %v", c.Listen, err)
+	}
+	log.Printf("simple-tcp-proxy listening on %s, backend %s, max clients %d", listener.Addr(), c.Backend, c.MaxClients)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- frontend.Serve(listener)
+	}()
+
+	var metricsServer *http.Server
+	if c.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proxy.MetricsHandler(p))
+		metricsServer = &http.Server{Addr: c.MetricsListen, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("serve metrics failed: %v", err)
+			}
+		}()
+		log.Printf("serving metrics on %s/metrics", c.MetricsListen)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+		if err := frontend.Close(); err != nil {
+			log.Printf("close frontend: %v", err)
+		}
+		<-served
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		if err := p.Close(); err != nil {
+			log.Printf("close proxy: %v", err)
+		}
+	case err := <-served:
+		log.Fatalf("serve failed: %v", err)
+	}
+	log.Printf("simple-tcp-proxy stopped")
+}
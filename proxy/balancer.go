@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+const (
+	//RoundRobinBalancerName 依次选择后端
+	RoundRobinBalancerName = "round-robin"
+	//LeastInUseBalancerName 选择正在使用的连接最少的后端
+	LeastInUseBalancerName = "least-in-use"
+	//PowerOfTwoChoicesBalancerName 随机选两个后端，再选正在使用的连接少的那个
+	PowerOfTwoChoicesBalancerName = "p2c"
+	//ConsistentHashBalancerName 按照请求内容做一致性哈希
+	ConsistentHashBalancerName = "consistent-hash"
+
+	//defaultHashReplicas 一致性哈希每个后端的虚拟节点数
+	defaultHashReplicas = 100
+)
+
+//Backend NewMultiProxy的一个后端
+type Backend struct {
+	//Name 后端的名字，一致性哈希使用它计算位置；为空时如果Server有Addr() string方法就使用地址，否则是backend-下标
+	Name string
+	//Server 后端
+	Server server.Server
+	//MaxClient 到这个后端的最大连接数，0表示只受Proxy总的最大连接数限制
+	MaxClient int
+}
+
+//BackendState 选择后端时每个后端的状态，顺序和NewMultiProxy的backends一致
+type BackendState struct {
+	//Name 后端的名字
+	Name string
+	//Open 已经建立的连接数
+	Open int
+	//InUse 正在使用的连接数
+	InUse int
+	//Idle 空闲的连接数
+	Idle int
+	//Ejected 连续失败被摘除了，见WithOutlierDetection
+	Ejected bool
+	//Circuit 熔断器的状态，见WithCircuitBreaker
+	Circuit CircuitState
+	//Available 没有被摘除，熔断器放行，并且有空闲连接或者还可以新建连接
+	Available bool
+}
+
+//Balancer 负载均衡策略，每次请求选择一个后端；在Proxy的锁内调用，不能阻塞
+type Balancer interface {
+	//Pick 返回一个Available的后端的下标；query在后台补齐连接和把名额交给排队的请求时为nil
+	Pick(query []byte, backends []BackendState) int
+}
+
+//GetBalancer 按照名字新建一个内置的负载均衡策略
+func GetBalancer(name string) (Balancer, bool) {
+	switch name {
+	case RoundRobinBalancerName:
+		return RoundRobin(), true
+	case LeastInUseBalancerName:
+		return LeastInUse(), true
+	case PowerOfTwoChoicesBalancerName:
+		return PowerOfTwoChoices(), true
+	case ConsistentHashBalancerName:
+		return ConsistentHash(defaultHashReplicas), true
+	}
+	return nil, false
+}
+
+//RoundRobin 依次选择可用的后端
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (b *roundRobin) Pick(_ []byte, backends []BackendState) int {
+	start := atomic.AddUint32(&b.next, 1) - 1
+	for i := range backends {
+		index := int((start + uint32(i)) % uint32(len(backends)))
+		if backends[index].Available {
+			return index
+		}
+	}
+	return -1
+}
+
+//LeastInUse 选择正在使用的连接最少的可用后端，一样多时选择靠前的
+func LeastInUse() Balancer {
+	return leastInUse{}
+}
+
+type leastInUse struct{}
+
+func (leastInUse) Pick(_ []byte, backends []BackendState) int {
+	picked := -1
+	for i, state := range backends {
+		if state.Available && (picked < 0 || state.InUse < backends[picked].InUse) {
+			picked = i
+		}
+	}
+	return picked
+}
+
+//PowerOfTwoChoices 随机选两个可用的后端，再选正在使用的连接少的那个，比LeastInUse更不容易让所有请求涌向同一个后端
+func PowerOfTwoChoices() Balancer {
+	return powerOfTwoChoices{}
+}
+
+type powerOfTwoChoices struct{}
+
+func (powerOfTwoChoices) Pick(_ []byte, backends []BackendState) int {
+	available := make([]int, 0, len(backends))
+	for i, state := range backends {
+		if state.Available {
+			available = append(available, i)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return -1
+	case 1:
+		return available[0]
+	}
+	first := rand.Intn(len(available))
+	second := rand.Intn(len(available) - 1)
+	if second >= first {
+		second++
+	}
+	a, b := available[first], available[second]
+	if backends[b].InUse < backends[a].InUse {
+		return b
+	}
+	return a
+}
+
+//ConsistentHash 按照请求内容做一致性哈希，同样的请求总是选择同一个后端；后端不可用时顺着哈希环选择下一个
+//每个后端replicas个虚拟节点，哈希环在第一次选择时按照后端的名字建立
+func ConsistentHash(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+	return &consistentHash{replicas: replicas}
+}
+
+type hashNode struct {
+	hash  uint32
+	index int
+}
+
+type consistentHash struct {
+	replicas int
+	once     sync.Once
+	ring     []hashNode
+}
+
+func (b *consistentHash) Pick(query []byte, backends []BackendState) int {
+	b.once.Do(func() {
+		for i, state := range backends {
+			for replica := 0; replica < b.replicas; replica++ {
+				b.ring = append(b.ring, hashNode{hash: hashBytes([]byte(state.Name + "#" + strconv.Itoa(replica))), index: i})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool {
+			return b.ring[i].hash < b.ring[j].hash
+		})
+	})
+	hash := hashBytes(query)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := range b.ring {
+		node := b.ring[(start+i)%len(b.ring)]
+		if node.index < len(backends) && backends[node.index].Available {
+			return node.index
+		}
+	}
+	return -1
+}
+
+func hashBytes(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+//backend 一个后端的连接池状态，都需要在Proxy的锁内访问
+type backend struct {
+	name string
+	//在Proxy中的下标
+	index int
+	s     server.Server
+	//最大连接数，0表示不限制
+	maxClient int
+	//已经建立的连接数
+	open int
+	//已经占用了名额、但还没有建立的连接数
+	pending int
+	//连续失败的次数
+	failures int
+	//是否被摘除了
+	ejected bool
+	//被连续摘除的次数，决定摘除的时间
+	ejections int
+	//最后一次恢复的时间
+	restoredAt time.Time
+	//熔断器的状态
+	circuit CircuitState
+	//熔断器关闭状态下连续失败的次数
+	circuitFailures int
+	//半开状态下正在进行的试探请求数
+	trials int
+	//最后一次熔断的时间
+	openedAt time.Time
+}
+
+func newBackends(backends []Backend) []*backend {
+	result := make([]*backend, 0, len(backends))
+	for i, b := range backends {
+		name := b.Name
+		if name == "" {
+			if addr, ok := b.Server.(interface{ Addr() string }); ok {
+				name = addr.Addr()
+			} else {
+				name = fmt.Sprintf("backend-%d", i)
+			}
+		}
+		result = append(result, &backend{name: name, index: i, s: b.Server, maxClient: b.MaxClient})
+	}
+	return result
+}
+
+//backendStatesLocked 统计每个后端的状态，同时找到每个后端的一个可以使用的空闲连接（跳过超过最大生命周期的）
+func (p *ServerProxy) backendStatesLocked(now time.Time) ([]BackendState, []server.Client) {
+	states := make([]BackendState, len(p.backends))
+	idle := make([]server.Client, len(p.backends))
+	for client, info := range p.clients {
+		i := info.backend.index
+		if _, busy := p.dependencies[client]; busy {
+			states[i].InUse++
+			continue
+		}
+		states[i].Idle++
+		if idle[i] == nil && !p.expiredLocked(info, now) {
+			idle[i] = client
+		}
+	}
+	for i, b := range p.backends {
+		states[i].Name = b.name
+		states[i].Open = b.open
+		states[i].Ejected = b.ejected
+		states[i].Circuit = p.circuitStateLocked(b)
+		states[i].Available = !b.ejected && p.circuitAllowLocked(b) && (idle[i] != nil || p.canDialLocked(b))
+	}
+	return states, idle
+}
+
+//pickLocked 按照负载均衡策略选择一个后端，返回它的一个空闲连接；没有空闲连接时client为nil，需要新建连接
+//所有后端都不可用时返回nil
+func (p *ServerProxy) pickLocked(query []byte) (*backend, server.Client) {
+	states, idle := p.backendStatesLocked(p.opts.clock.Now())
+	index := p.pickIndexLocked(query, states)
+	if index < 0 {
+		return nil, nil
+	}
+	return p.backends[index], idle[index]
+}
+
+//pickDialLocked 按照负载均衡策略选择一个还可以新建连接的后端，都不可以时返回nil
+func (p *ServerProxy) pickDialLocked() *backend {
+	states, _ := p.backendStatesLocked(p.opts.clock.Now())
+	for i, b := range p.backends {
+		states[i].Available = p.canDialLocked(b)
+	}
+	index := p.pickIndexLocked(nil, states)
+	if index < 0 {
+		return nil
+	}
+	return p.backends[index]
+}
+
+//pickIndexLocked 只有一个后端时不需要负载均衡策略；策略返回了不可用的后端时当作都不可用
+func (p *ServerProxy) pickIndexLocked(query []byte, states []BackendState) int {
+	index := 0
+	if len(states) > 1 {
+		index = p.opts.balancer.Pick(query, states)
+	}
+	if index < 0 || index >= len(states) || !states[index].Available {
+		return -1
+	}
+	return index
+}
@@ -0,0 +1,198 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+//repeatResponse 每个请求都返回 D+name 和 Z
+func repeatResponse(name string, times int) [][]byte {
+	var response [][]byte
+	for i := 0; i < times; i++ {
+		response = append(response, []byte("D"+name), []byte("Z"))
+	}
+	return response
+}
+
+//readFirst 读取第一帧，然后读完response
+func readFirst(response *proxy.Response) string {
+	protocol, err := response.Read()
+	gomega.Expect(err).To(gomega.BeNil())
+	first := string(protocol)
+	readAll(response)
+	return first
+}
+
+var _ = ginkgo.Describe("Balancer", func() {
+	var states []proxy.BackendState
+
+	ginkgo.BeforeEach(func() {
+		states = []proxy.BackendState{
+			{Name: "a", InUse: 3, Available: true},
+			{Name: "b", InUse: 1, Available: true},
+			{Name: "c", InUse: 2, Available: true},
+		}
+	})
+
+	ginkgo.It("round robin pick available backends in turn", func() {
+		balancer := proxy.RoundRobin()
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(0))
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(1))
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(2))
+		states[0].Available = false
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(1))
+	})
+
+	ginkgo.It("least in use pick the available backend with the fewest clients in use", func() {
+		balancer := proxy.LeastInUse()
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(1))
+		states[1].Available = false
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("power of two choices never pick the busiest backend of three", func() {
+		balancer := proxy.PowerOfTwoChoices()
+		for i := 0; i < 100; i++ {
+			gomega.Expect(balancer.Pick(nil, states)).NotTo(gomega.Equal(0))
+		}
+		states[1].Available, states[2].Available = false, false
+		gomega.Expect(balancer.Pick(nil, states)).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("consistent hash pick the same backend for the same query", func() {
+		balancer := proxy.ConsistentHash(0)
+		picked := make(map[int]bool)
+		for i := 0; i < 100; i++ {
+			query := []byte(fmt.Sprintf("Qkey%d", i))
+			index := balancer.Pick(query, states)
+			gomega.Expect(balancer.Pick(query, states)).To(gomega.Equal(index))
+			picked[index] = true
+
+			ginkgo.By("move to another backend only when the backend is unavailable")
+			states[index].Available = false
+			gomega.Expect(balancer.Pick(query, states)).NotTo(gomega.Equal(index))
+			states[index].Available = true
+		}
+		gomega.Expect(picked).To(gomega.HaveLen(3))
+	})
+
+	ginkgo.It("return -1 when no backend is available", func() {
+		for i := range states {
+			states[i].Available = false
+		}
+		for _, name := range []string{proxy.RoundRobinBalancerName, proxy.LeastInUseBalancerName,
+			proxy.PowerOfTwoChoicesBalancerName, proxy.ConsistentHashBalancerName} {
+			balancer, exists := proxy.GetBalancer(name)
+			gomega.Expect(exists).To(gomega.BeTrue())
+			gomega.Expect(balancer.Pick([]byte("Qkey"), states)).To(gomega.Equal(-1))
+		}
+	})
+})
+
+var _ = ginkgo.Describe("Multiple backends", func() {
+	var first, second *mockProxyServer
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		first = &mockProxyServer{response: repeatResponse("first", 20)}
+		second = &mockProxyServer{response: repeatResponse("second", 20)}
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("round robin is used", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewMultiProxy(4, []proxy.Backend{{Server: first}, {Server: second}})
+		})
+
+		ginkgo.It("spread clients over backends", func() {
+			for i := 0; i < 4; i++ {
+				_, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+			}
+			gomega.Expect(first.ClientCount()).To(gomega.Equal(2))
+			gomega.Expect(second.ClientCount()).To(gomega.Equal(2))
+
+			_, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrClientCountExceeded))
+		})
+	})
+
+	ginkgo.When("backend has its own limit", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewMultiProxy(5, []proxy.Backend{{Server: first, MaxClient: 1}, {Server: second, MaxClient: 2}},
+				proxy.WithBalancer(proxy.LeastInUse()))
+		})
+
+		ginkgo.It("dial other backends when one is full, and never exceed any limit", func() {
+			for i := 0; i < 3; i++ {
+				_, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+			}
+			gomega.Expect(first.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(second.ClientCount()).To(gomega.Equal(2))
+
+			_, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrClientCountExceeded))
+		})
+
+		ginkgo.It("hand the released slot to waiting request on the same backend", func() {
+			first.response = [][]byte{[]byte("bad protocol")}
+			responses := make([]*proxy.Response, 0, 3)
+			for i := 0; i < 3; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				responses = append(responses, response)
+			}
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := p.RequestContext(context.Background(), []byte("Qxxxxx"))
+				result <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+
+			ginkgo.By("remove the client of the first backend")
+			for _, response := range responses {
+				if _, err := response.Read(); err == proxy.ErrResponseProtocolFormat {
+					break
+				}
+			}
+			gomega.Eventually(result).Should(gomega.Receive(gomega.BeNil()))
+			gomega.Expect(first.ClientCount()).To(gomega.Equal(2))
+			gomega.Expect(second.ClientCount()).To(gomega.Equal(2))
+		})
+	})
+
+	ginkgo.When("consistent hash is used", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewMultiProxy(4, []proxy.Backend{{Name: "first", Server: first}, {Name: "second", Server: second}},
+				proxy.WithBalancer(proxy.ConsistentHash(0)))
+		})
+
+		ginkgo.It("send the same query to the same backend", func() {
+			served := make(map[string]string)
+			for round := 0; round < 2; round++ {
+				for i := 0; i < 8; i++ {
+					query := fmt.Sprintf("Qkey%d", i)
+					response, err := p.Request([]byte(query))
+					gomega.Expect(err).To(gomega.BeNil())
+					backend := readFirst(response)
+					if round == 0 {
+						served[query] = backend
+					}
+					gomega.Expect(backend).To(gomega.Equal(served[query]))
+				}
+			}
+			gomega.Expect(first.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(second.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+})
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+//ErrCircuitOpen 所有后端都熔断了，请求直接失败，不再等待建立连接超时
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	//defaultFailureThreshold 连续失败多少次后熔断
+	defaultFailureThreshold = 5
+	//defaultOpenTimeout 熔断多久后进入半开状态
+	defaultOpenTimeout = 10 * time.Second
+	//defaultHalfOpenRequests 半开状态下同时放行的试探请求数
+	defaultHalfOpenRequests = 1
+)
+
+//CircuitBreaker 每个后端一个熔断器，包住Connect和Client.Request：
+//关闭状态下连续失败（建立连接失败、读写失败、报文格式错误导致连接被删除，调用方清空超限、RemoveClient等不算）达到FailureThreshold次后熔断，
+//熔断期间不再使用这个后端，所有后端都熔断时请求直接返回ErrCircuitOpen；
+//熔断OpenTimeout之后进入半开状态，最多同时放行HalfOpenRequests个试探请求，一个成功就关闭熔断，一个失败就重新熔断
+type CircuitBreaker struct {
+	//FailureThreshold 连续失败多少次后熔断，0表示使用默认值5
+	FailureThreshold int
+	//OpenTimeout 熔断多久后进入半开状态，0表示使用默认值10s
+	OpenTimeout time.Duration
+	//HalfOpenRequests 半开状态下最多同时放行的试探请求数，0表示使用默认值1
+	HalfOpenRequests int
+}
+
+//CircuitState 熔断器的状态
+type CircuitState int
+
+const (
+	//CircuitClosed 正常放行
+	CircuitClosed CircuitState = iota
+	//CircuitOpen 熔断，不放行
+	CircuitOpen
+	//CircuitHalfOpen 放行有限的试探请求
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func (c *CircuitBreaker) failureThreshold() int {
+	if c.FailureThreshold <= 0 {
+		return defaultFailureThreshold
+	}
+	return c.FailureThreshold
+}
+
+func (c *CircuitBreaker) openTimeout() time.Duration {
+	if c.OpenTimeout <= 0 {
+		return defaultOpenTimeout
+	}
+	return c.OpenTimeout
+}
+
+func (c *CircuitBreaker) halfOpenRequests() int {
+	if c.HalfOpenRequests <= 0 {
+		return defaultHalfOpenRequests
+	}
+	return c.HalfOpenRequests
+}
+
+//circuitStateLocked b的熔断器的状态，熔断超过OpenTimeout时进入半开状态
+func (p *ServerProxy) circuitStateLocked(b *backend) CircuitState {
+	breaker := p.opts.circuitBreaker
+	if breaker == nil {
+		return CircuitClosed
+	}
+	if b.circuit == CircuitOpen && p.opts.clock.Now().Sub(b.openedAt) >= breaker.openTimeout() {
+		b.circuit = CircuitHalfOpen
+		b.trials = 0
+	}
+	return b.circuit
+}
+
+//circuitAllowLocked b的熔断器是否放行一个新的请求
+func (p *ServerProxy) circuitAllowLocked(b *backend) bool {
+	switch p.circuitStateLocked(b) {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return b.trials < p.opts.circuitBreaker.halfOpenRequests()
+	default:
+		return true
+	}
+}
+
+//circuitOpenLocked 所有后端的熔断器都不放行
+func (p *ServerProxy) circuitOpenLocked() bool {
+	for _, b := range p.backends {
+		if p.circuitAllowLocked(b) {
+			return false
+		}
+	}
+	return true
+}
+
+//takeTrialLocked 请求被放行到b，半开状态下占用一个试探名额
+func (p *ServerProxy) takeTrialLocked(b *backend) {
+	if p.circuitStateLocked(b) == CircuitHalfOpen {
+		b.trials++
+	}
+}
+
+//cancelTrialLocked 放行到b的请求没有使用就放弃了，归还试探名额
+func (p *ServerProxy) cancelTrialLocked(b *backend) {
+	if b.circuit == CircuitHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+//circuitSuccessLocked b的一次请求成功了，关闭熔断
+func (p *ServerProxy) circuitSuccessLocked(b *backend) {
+	reclosed := b.circuit != CircuitClosed
+	b.circuit = CircuitClosed
+	b.circuitFailures = 0
+	b.trials = 0
+	if reclosed {
+		//后端又可以新建连接了
+		p.releaseSlotLocked()
+		p.refillLocked()
+	}
+}
+
+//circuitFailureLocked b的一次失败，关闭状态下达到连续失败次数或者半开状态下试探失败时熔断
+func (p *ServerProxy) circuitFailureLocked(b *backend) {
+	breaker := p.opts.circuitBreaker
+	if breaker == nil {
+		return
+	}
+	switch p.circuitStateLocked(b) {
+	case CircuitOpen:
+		return
+	case CircuitClosed:
+		if b.circuitFailures++; b.circuitFailures < breaker.failureThreshold() {
+			return
+		}
+	}
+	b.circuit = CircuitOpen
+	b.openedAt = p.opts.clock.Now()
+	b.circuitFailures = 0
+	b.trials = 0
+	//没有后端可以用了，排队的请求不用再等
+	if p.circuitOpenLocked() {
+		for req := p.nextWaiterLocked(); req != nil; req = p.nextWaiterLocked() {
+			req <- connRequest{err: ErrCircuitOpen}
+		}
+	}
+}
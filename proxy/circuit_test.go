@@ -0,0 +1,171 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+var _ = ginkgo.Describe("Circuit breaker", func() {
+	var s *mockProxyServer
+	var clock *fakeClock
+	var breaker proxy.CircuitBreaker
+	var maxClient int
+	var extra []proxy.Option
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: repeatResponse("ok", 20), failures: 2}
+		clock = newFakeClock()
+		breaker = proxy.CircuitBreaker{FailureThreshold: 2, OpenTimeout: time.Minute}
+		maxClient = 4
+		extra = nil
+	})
+
+	ginkgo.JustBeforeEach(func() {
+		opts := append([]proxy.Option{proxy.WithCircuitBreaker(breaker), proxy.WithClock(clock)}, extra...)
+		p = proxy.NewProxy(maxClient, s, opts...)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	//openCircuit 连续两次建立连接失败后熔断
+	openCircuit := func() {
+		for i := 0; i < 2; i++ {
+			_, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(errors.Is(err, server.ErrConnectFailed)).To(gomega.BeTrue())
+		}
+	}
+
+	ginkgo.It("fail fast while the circuit is open", func() {
+		openCircuit()
+		_, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrCircuitOpen))
+		ginkgo.By("waiting requests fail fast too")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = p.RequestContext(ctx, []byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrCircuitOpen))
+		gomega.Expect(s.Attempts()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("let limited trial requests through when half-open and close on success", func() {
+		openCircuit()
+		clock.Advance(time.Minute)
+		trial, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		_, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrCircuitOpen))
+
+		gomega.Expect(readFirst(trial)).To(gomega.Equal("Dok"))
+		for i := 0; i < 2; i++ {
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(readFirst(response)).To(gomega.Equal("Dok"))
+		}
+	})
+
+	ginkgo.It("open again when the trial failed", func() {
+		s.failures = 3
+		openCircuit()
+		clock.Advance(time.Minute)
+		_, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(errors.Is(err, server.ErrConnectFailed)).To(gomega.BeTrue())
+		_, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrCircuitOpen))
+		gomega.Expect(s.Attempts()).To(gomega.Equal(3))
+
+		clock.Advance(time.Minute)
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(readFirst(response)).To(gomega.Equal("Dok"))
+	})
+
+	ginkgo.When("callers abandon responses over the drain limit", func() {
+		ginkgo.BeforeEach(func() {
+			extra = []proxy.Option{proxy.WithDrainLimit(2)}
+		})
+
+		//abandon 发送一个请求，不读就Close，超出清空的字节数
+		abandon := func() {
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(response.Close()).To(gomega.Equal(proxy.ErrDrainLimitExceeded))
+		}
+
+		ginkgo.It("never open the circuit", func() {
+			s.failures = 0
+			for i := 0; i < 3; i++ {
+				abandon()
+			}
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(readFirst(response)).To(gomega.Equal("Dok"))
+		})
+
+		ginkgo.It("give the trial back when half-open", func() {
+			openCircuit()
+			clock.Advance(time.Minute)
+			abandon()
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(readFirst(response)).To(gomega.Equal("Dok"))
+		})
+	})
+
+	ginkgo.When("requests are waiting for a connection", func() {
+		ginkgo.BeforeEach(func() {
+			s.failures = 0
+			s.badRead = 1
+			breaker.FailureThreshold = 1
+			maxClient = 1
+		})
+
+		ginkgo.It("fail them when the circuit opens", func() {
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+
+			waited := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_, err := p.RequestContext(ctx, []byte("Qxxxxx"))
+				waited <- err
+			}()
+			gomega.Consistently(waited, 20*time.Millisecond).ShouldNot(gomega.Receive())
+
+			_, err = response.Read()
+			gomega.Expect(err).NotTo(gomega.BeNil())
+			gomega.Eventually(waited).Should(gomega.Receive(gomega.Equal(proxy.ErrCircuitOpen)))
+			gomega.Expect(s.Attempts()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("there are other backends", func() {
+		var second *mockProxyServer
+
+		ginkgo.JustBeforeEach(func() {
+			p.Close()
+			second = &mockProxyServer{response: repeatResponse("second", 20)}
+			p = proxy.NewMultiProxy(maxClient, []proxy.Backend{{Server: s}, {Server: second}},
+				proxy.WithBalancer(proxy.LeastInUse()), proxy.WithCircuitBreaker(breaker), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("skip the backend whose circuit is open", func() {
+			openCircuit()
+			for i := 0; i < 3; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(readFirst(response)).To(gomega.Equal("Dsecond"))
+			}
+			gomega.Expect(s.Attempts()).To(gomega.Equal(2))
+		})
+	})
+})
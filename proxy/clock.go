@@ -0,0 +1,22 @@
+package proxy
+
+import "time"
+
+//Clock 时间来源，后台清理等逻辑都通过它获取时间，测试时可以换成假的时钟
+type Clock interface {
+	//Now 当前时间
+	Now() time.Time
+	//After 和time.After一样，d之后channel中可以读到当时的时间
+	After(d time.Duration) <-chan time.Time
+}
+
+//systemClock 系统时钟，默认使用
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
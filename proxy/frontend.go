@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//ErrFrontendClosed Frontend已经关闭
+var ErrFrontendClosed = errors.New("proxy frontend closed")
+
+//Frontend 面向用户的监听服务，接收用户的TCP连接，把用户的`Q`请求转发给Proxy，并把`D`和最后的`Z`写回给用户
+//用户与Proxy之间也是单双工的：用户发送一个请求，读完全部返回后才能发送下一个请求
+type Frontend struct {
+	proxy Proxy
+	//Close时取消，让排队等待连接的请求返回
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	isClosed  bool
+	//等待所有连接处理完成
+	wg sync.WaitGroup
+}
+
+//NewFrontend 新建一个Frontend，请求都转发给p
+func NewFrontend(p Proxy) *Frontend {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Frontend{
+		proxy:     p,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+//Serve 使用p处理l上的所有连接，和http.Serve类似
+func Serve(l net.Listener, p Proxy) error {
+	return NewFrontend(p).Serve(l)
+}
+
+//ListenAndServe 监听addr，并使用p处理所有连接
+func ListenAndServe(addr string, p Proxy) error {
+	return NewFrontend(p).ListenAndServe(addr)
+}
+
+//ListenAndServe 监听addr，并处理所有连接
+func (f *Frontend) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return f.Serve(l)
+}
+
+//Serve 接收l上的连接，每个连接一个goroutine；l会在Serve返回时被关闭。Close后返回ErrFrontendClosed
+func (f *Frontend) Serve(l net.Listener) error {
+	if !f.trackListener(l) {
+		l.Close()
+		return ErrFrontendClosed
+	}
+	defer f.untrackListener(l)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if f.closed() {
+				return ErrFrontendClosed
+			}
+			var netErr net.Error
+			//临时错误（比如文件描述符不够了）等一会儿继续接收，和net/http的处理方式一样
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		if !f.trackConn(conn) {
+			conn.Close()
+			return ErrFrontendClosed
+		}
+		go func() {
+			defer f.untrackConn(conn)
+			f.handle(conn)
+		}()
+	}
+}
+
+//Close 关闭所有的listener和用户连接，并等待所有连接处理完成
+func (f *Frontend) Close() error {
+	f.lock.Lock()
+	f.isClosed = true
+	f.cancel()
+	var err error
+	for l := range f.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.lock.Unlock()
+
+	f.wg.Wait()
+	return err
+}
+
+//handle 处理一个用户连接，单双工循环：读请求，转发给proxy，写回所有protocol
+func (f *Frontend) handle(conn net.Conn) {
+	defer conn.Close()
+	//请求报文大小可以一次性接收，见README
+	query := make([]byte, MaxProtocolLength)
+	for {
+		n, err := conn.Read(query)
+		if err != nil {
+			return
+		}
+		//连接数已满时排队等待，不直接断开用户
+		response, err := f.proxy.RequestContext(f.ctx, query[:n])
+		//不以'Q'开头的请求直接丢弃
+		if errors.Is(err, ErrBadRequest) {
+			continue
+		}
+		//协议中没有错误帧，只能关闭连接通知用户
+		if err != nil {
+			return
+		}
+		if err := writeResponse(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+//writeResponse 把response的帧原样写回给用户，包括错误帧和结束帧（默认是`Z`）；用户断开时会清空server端未读的报文，回收连接
+func writeResponse(conn net.Conn, response *Response) error {
+	_, err := response.Reader(RawFrames).WriteTo(conn)
+	return err
+}
+
+func (f *Frontend) closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.isClosed
+}
+
+func (f *Frontend) trackListener(l net.Listener) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.isClosed {
+		return false
+	}
+	f.listeners[l] = struct{}{}
+	return true
+}
+
+func (f *Frontend) untrackListener(l net.Listener) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.listeners, l)
+	l.Close()
+}
+
+func (f *Frontend) trackConn(conn net.Conn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.isClosed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	f.wg.Add(1)
+	return true
+}
+
+func (f *Frontend) untrackConn(conn net.Conn) {
+	f.lock.Lock()
+	delete(f.conns, conn)
+	f.lock.Unlock()
+	f.wg.Done()
+}
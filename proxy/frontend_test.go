@@ -0,0 +1,188 @@
+package proxy_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+//pipeListener 只返回一个net.Pipe连接的listener，用户端关闭后frontend的写会立即失败
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func newPipeListener() (*pipeListener, net.Conn) {
+	userConn, proxyConn := net.Pipe()
+	l := &pipeListener{conns: make(chan net.Conn, 1), done: make(chan struct{})}
+	l.conns <- proxyConn
+	return l, userConn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+//readUntilEnd 读取到`Z`为止
+func readUntilEnd(conn net.Conn) (string, error) {
+	var result []byte
+	data := make([]byte, 1024)
+	for {
+		n, err := conn.Read(data)
+		if err != nil {
+			return string(result), err
+		}
+		result = append(result, data[:n]...)
+		if result[len(result)-1] == proxy.ResponseEndChar {
+			return string(result), nil
+		}
+	}
+}
+
+var _ = ginkgo.Describe("Frontend", func() {
+	var s *mockProxyServer
+	var p *proxy.ServerProxy
+	var frontend *proxy.Frontend
+
+	ginkgo.Describe("serve tcp connection", func() {
+		var listener net.Listener
+		var served chan error
+
+		ginkgo.BeforeEach(func() {
+			s = &mockProxyServer{
+				response: [][]byte{
+					[]byte("DaaaaaaaaaDbbbbbbbb"), []byte("Z"),
+					[]byte("Dcccccccc"), []byte("Z"),
+				},
+			}
+			p = proxy.NewProxy(5, s)
+			frontend = proxy.NewFrontend(p)
+
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			f, l, ch := frontend, listener, make(chan error, 1)
+			served = ch
+			go func() {
+				ch <- f.Serve(l)
+			}()
+		})
+
+		ginkgo.AfterEach(func() {
+			frontend.Close()
+		})
+
+		ginkgo.It("stream all protocol and the end to user", func() {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			defer conn.Close()
+
+			ginkgo.By("first request")
+			_, err = conn.Write([]byte("Qfirst"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			result, err := readUntilEnd(conn)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(result).To(gomega.Equal("DaaaaaaaaaDbbbbbbbbZ"))
+
+			ginkgo.By("second request on the same connection")
+			_, err = conn.Write([]byte("Qsecond"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			result, err = readUntilEnd(conn)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(result).To(gomega.Equal("DccccccccZ"))
+
+			ginkgo.By("backend client is reused")
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+
+		ginkgo.It("discard request not start with 'Q'", func() {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("xxxxx"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			ginkgo.By("no response for bad request")
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1024))
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.(net.Error).Timeout()).To(gomega.BeTrue())
+
+			ginkgo.By("connection still works")
+			conn.SetReadDeadline(time.Time{})
+			_, err = conn.Write([]byte("Qfirst"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			result, err := readUntilEnd(conn)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(result).To(gomega.Equal("DaaaaaaaaaDbbbbbbbbZ"))
+		})
+
+		ginkgo.It("return ErrFrontendClosed after close", func() {
+			gomega.Expect(frontend.Close()).To(gomega.Succeed())
+			gomega.Eventually(served).Should(gomega.Receive(gomega.Equal(proxy.ErrFrontendClosed)))
+		})
+	})
+
+	ginkgo.Describe("user disconnect in the middle of a response", func() {
+		var userConn net.Conn
+
+		ginkgo.BeforeEach(func() {
+			s = &mockProxyServer{
+				response: [][]byte{
+					[]byte("Daaaa"), []byte("Dbbbb"), []byte("Dcccc"), []byte("Z"),
+				},
+			}
+			p = proxy.NewProxy(1, s)
+			frontend = proxy.NewFrontend(p)
+			var listener *pipeListener
+			listener, userConn = newPipeListener()
+			go frontend.Serve(listener)
+		})
+
+		ginkgo.AfterEach(func() {
+			frontend.Close()
+		})
+
+		ginkgo.It("close the response and recycle the client", func() {
+			_, err := userConn.Write([]byte("Qfirst"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			data := make([]byte, 1024)
+			n, err := userConn.Read(data)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data[:n])).To(gomega.Equal("Daaaa"))
+			userConn.Close()
+
+			ginkgo.By("client is recycled and can be reused")
+			gomega.Eventually(func() error {
+				_, err := p.Request([]byte("Qsecond"))
+				return err
+			}).Should(gomega.Succeed())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+
+			ginkgo.By("remaining protocol is drained")
+			gomega.Expect(len(s.clients)).To(gomega.Equal(1))
+			gomega.Expect(s.clients[0].index).To(gomega.Equal(len(s.response)))
+		})
+	})
+})
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//ErrHealthCheckTimeout 健康检查的延迟超过了HealthCheckConfig.Timeout
+var ErrHealthCheckTimeout = errors.New("health check exceeded latency threshold")
+
+//HealthCheckConfig 空闲连接健康检查的配置
+type HealthCheckConfig struct {
+	//Query 探测请求，比如`Qping`，需要通过codec的校验；server返回的报文会被读到结束帧
+	Query []byte
+	//Interval 后台检查的间隔，空闲（没有被使用也没有被检查）超过这个时间的连接才会被检查；0表示不在后台检查，只能调用CheckHealth
+	Interval time.Duration
+	//Timeout 探测的延迟上限，超过后删除连接，0表示不限制；client实现了server.DeadlineClient时会设置读超时
+	Timeout time.Duration
+	//OnResult 每检查完一个连接调用一次，可以为nil；在检查的goroutine中调用，不要阻塞
+	OnResult func(HealthCheckResult)
+}
+
+//HealthCheckResult 一个连接的检查结果
+type HealthCheckResult struct {
+	//Client 被检查的连接
+	Client server.Client
+	//Time 开始检查的时间
+	Time time.Time
+	//Latency 发送探测请求到读到结束帧的时间
+	Latency time.Duration
+	//Err nil表示连接是健康的，否则连接已经被删除
+	Err error
+}
+
+//ValidationConfig 从连接池取出空闲连接时的校验配置
+type ValidationConfig struct {
+	//Window 上一次使用或者检查在Window之内的连接跳过校验，0表示每次都校验
+	Window time.Duration
+	//Query 探测请求，比如`Qping`，会读到结束帧；为nil时使用server.LivenessClient的CheckAlive，client不支持时不校验
+	Query []byte
+	//Timeout 探测请求的读超时，client实现了server.DeadlineClient时有效，0表示不限制
+	Timeout time.Duration
+}
+
+//CheckHealth 立即检查所有的空闲连接，返回每个连接的检查结果；没有配置WithHealthCheck时什么都不做
+func (p *ServerProxy) CheckHealth() []HealthCheckResult {
+	return p.checkHealth(0)
+}
+
+//checker 后台定时检查空闲连接，直到Close
+func (p *ServerProxy) checker() {
+	defer p.wg.Done()
+	interval := p.opts.healthCheck.Interval
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.opts.clock.After(interval):
+		}
+		p.checkHealth(interval)
+	}
+}
+
+//checkHealth 逐个检查空闲超过idle的连接；检查期间只占用正在检查的这一个连接
+func (p *ServerProxy) checkHealth(idle time.Duration) []HealthCheckResult {
+	if p.opts.healthCheck.Query == nil {
+		return nil
+	}
+	var results []HealthCheckResult
+	checked := make(map[server.Client]bool)
+	for {
+		client := p.reserveUncheckedClient(idle, checked)
+		if client == nil {
+			return results
+		}
+		checked[client] = true
+		result := p.checkClient(client)
+		if p.opts.healthCheck.OnResult != nil {
+			p.opts.healthCheck.OnResult(result)
+		}
+		results = append(results, result)
+	}
+}
+
+//reserveUncheckedClient 占用一个这一轮还没有检查过、并且空闲超过idle的连接
+func (p *ServerProxy) reserveUncheckedClient(idle time.Duration, checked map[server.Client]bool) server.Client {
+	now := p.opts.clock.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isClosed {
+		return nil
+	}
+	for client, info := range p.clients {
+		if _, busy := p.dependencies[client]; busy || checked[client] {
+			continue
+		}
+		lastActive := info.returnedAt
+		if info.checkedAt.After(lastActive) {
+			lastActive = info.checkedAt
+		}
+		if now.Sub(lastActive) < idle {
+			continue
+		}
+		info.checkedAt = now
+		p.dependencies[client] = nil
+		return client
+	}
+	return nil
+}
+
+//checkClient 检查一个已经占用的连接，健康的连接被回收，否则被删除
+func (p *ServerProxy) checkClient(client server.Client) HealthCheckResult {
+	result := HealthCheckResult{Client: client, Time: p.opts.clock.Now()}
+	result.Err = p.probe(client, p.opts.healthCheck.Query, p.opts.healthCheck.Timeout)
+	result.Latency = p.opts.clock.Now().Sub(result.Time)
+	if result.Err == nil && p.opts.healthCheck.Timeout > 0 && result.Latency > p.opts.healthCheck.Timeout {
+		result.Err = ErrHealthCheckTimeout
+	}
+	if result.Err != nil {
+		p.removeClient(client, result.Err)
+	} else {
+		p.putClient(client, false)
+	}
+	return result
+}
+
+//probe 在client上发送探测请求，并和Response.Close一样逐帧读到结束帧，只受timeout限制，不受WithDrainLimit和WithDrainTimeout的限制；不回收也不删除连接
+func (p *ServerProxy) probe(client server.Client, query []byte, timeout time.Duration) error {
+	if err := p.opts.codec.ValidateRequest(query); err != nil {
+		return err
+	}
+	deadlineClient, canDeadline := client.(server.DeadlineClient)
+	if timeout > 0 && canDeadline {
+		if err := deadlineClient.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	if err := client.Request(query); err != nil {
+		return err
+	}
+	response := newResponse(client, p, p.opts)
+	err := response.drain(0, timeout)
+	putBuffer(response.data)
+	response.isClosed = true
+	if err != nil {
+		if errors.Is(err, ErrDrainTimeout) {
+			return fmt.Errorf("%s[%w]", err.Error(), ErrHealthCheckTimeout)
+		}
+		return err
+	}
+	//连接要被复用，恢复读超时
+	if timeout > 0 && canDeadline {
+		return deadlineClient.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+//needValidateLocked 取出的空闲连接是否需要校验，需要时记录检查时间
+func (p *ServerProxy) needValidateLocked(client server.Client) bool {
+	info, exists := p.clients[client]
+	if p.opts.validation == nil || !exists {
+		return false
+	}
+	now := p.opts.clock.Now()
+	lastActive := info.returnedAt
+	if info.checkedAt.After(lastActive) {
+		lastActive = info.checkedAt
+	}
+	if p.opts.validation.Window > 0 && now.Sub(lastActive) < p.opts.validation.Window {
+		return false
+	}
+	info.checkedAt = now
+	return true
+}
+
+//validate 校验一个已经占用的空闲连接，不需要持有锁
+func (p *ServerProxy) validate(client server.Client) error {
+	config := p.opts.validation
+	if config.Query != nil {
+		return p.probe(client, config.Query, config.Timeout)
+	}
+	if alive, ok := client.(server.LivenessClient); ok {
+		return alive.CheckAlive()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package proxy_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+var _ = ginkgo.Describe("Health check", func() {
+	var backend *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+	var config proxy.HealthCheckConfig
+
+	ginkgo.BeforeEach(func() {
+		backend = &mockProxyServer{
+			response: [][]byte{
+				[]byte("Daaaaaaaaa"), []byte("Z"),
+				[]byte("Dpong"), []byte("Z"),
+			},
+		}
+		clock = newFakeClock()
+		config = proxy.HealthCheckConfig{Query: []byte("Qping")}
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("the idle client is healthy", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithHealthCheck(config), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("read the probe response to the end and keep the client", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			results := p.CheckHealth()
+			gomega.Expect(results).To(gomega.HaveLen(1))
+			gomega.Expect(results[0].Err).To(gomega.BeNil())
+			gomega.Expect(results[0].Client).To(gomega.Equal(backend.clients[0]))
+			gomega.Expect(backend.clients[0].index).To(gomega.Equal(4))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+
+		ginkgo.It("never check a client in use", func() {
+			_, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(p.CheckHealth()).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.When("drain limits are configured for abandoned responses", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithHealthCheck(config), proxy.WithClock(clock),
+				proxy.WithDrainLimit(4), proxy.WithDrainTimeout(time.Nanosecond))
+		})
+
+		ginkgo.It("not apply them to the probe", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			results := p.CheckHealth()
+			gomega.Expect(results).To(gomega.HaveLen(1))
+			gomega.Expect(results[0].Err).To(gomega.BeNil())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("the idle client is broken", func() {
+		ginkgo.BeforeEach(func() {
+			backend.response = backend.response[:2]
+			p = proxy.NewProxy(2, backend, proxy.WithHealthCheck(config), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("remove and close the client", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			results := p.CheckHealth()
+			gomega.Expect(results).To(gomega.HaveLen(1))
+			gomega.Expect(errors.Is(results[0].Err, proxy.ErrTruncatedResponse)).To(gomega.BeTrue())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.When("the probe is slower than the threshold", func() {
+		ginkgo.BeforeEach(func() {
+			config.Timeout = time.Second
+			backend.onRead = func() {
+				clock.Advance(600 * time.Millisecond)
+			}
+			p = proxy.NewProxy(2, backend, proxy.WithHealthCheck(config), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("remove the client and report the latency", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			results := p.CheckHealth()
+			gomega.Expect(results).To(gomega.HaveLen(1))
+			gomega.Expect(results[0].Err).To(gomega.Equal(proxy.ErrHealthCheckTimeout))
+			gomega.Expect(results[0].Latency).To(gomega.Equal(1200 * time.Millisecond))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+		})
+	})
+
+	ginkgo.When("check in background", func() {
+		var results chan proxy.HealthCheckResult
+
+		ginkgo.BeforeEach(func() {
+			results = make(chan proxy.HealthCheckResult, 10)
+			config.Interval = time.Minute
+			config.OnResult = func(result proxy.HealthCheckResult) {
+				results <- result
+			}
+			p = proxy.NewProxy(2, backend, proxy.WithHealthCheck(config), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("check clients idle for longer than the interval", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			clock.Advance(time.Minute)
+			var result proxy.HealthCheckResult
+			gomega.Eventually(results).Should(gomega.Receive(&result))
+			gomega.Expect(result.Err).To(gomega.BeNil())
+		})
+
+		ginkgo.It("skip clients used recently", func() {
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			clock.Advance(30 * time.Second)
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			clock.Advance(30 * time.Second)
+			ginkgo.By("wait for the checker to finish a round")
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			gomega.Expect(results).NotTo(gomega.Receive())
+		})
+	})
+})
@@ -0,0 +1,90 @@
+package proxy
+
+import "github.com/weenxin/simple-tcp-proxy/server"
+
+//Hooks 连接生命周期的回调，通过WithHooks配置，每个回调都可以为nil
+//回调都不在Proxy的锁内调用，可以在连接上通过ServerProxy.Exec发送请求，比如初始化会话或者重置状态
+type Hooks struct {
+	//OnConnect 新建连接之后、交给请求或者放入连接池之前调用，返回错误时关闭连接，请求返回这个错误，不计入后端的失败
+	OnConnect func(client server.Client) error
+	//OnCheckout 连接被一个请求占用时调用，在发送请求之前
+	OnCheckout func(client server.Client)
+	//OnCheckin 请求用完连接、PutClient回收之前调用，返回错误时删除连接而不是复用，不计入后端的失败
+	OnCheckin func(client server.Client) error
+	//OnDiscard 连接被删除、关闭之前调用；err是删除的原因，比如RemoveClient、OnCheckin失败或者读写失败，
+	//为nil时表示连接是被连接池清理的，比如空闲超时、超过最大生命周期、空闲连接超出上限、后端被摘除或者Proxy被关闭
+	OnDiscard func(client server.Client, err error)
+}
+
+//WithHooks 配置连接生命周期的回调，见Hooks
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+//Exec 在client上发送一个请求并读完response，不回收也不删除连接，用于Hooks中初始化会话或者重置状态
+//server返回错误帧时，读到结束帧之后返回*ServerError
+func (p *ServerProxy) Exec(client server.Client, query []byte) error {
+	if err := p.opts.codec.ValidateRequest(query); err != nil {
+		return err
+	}
+	if err := client.Request(query); err != nil {
+		return err
+	}
+	response := newResponse(client, p, p.opts)
+	defer func() {
+		putBuffer(response.data)
+		response.isClosed = true
+	}()
+	var serverErr error
+	for {
+		protocol, err := response.nextProtocol()
+		if err != nil {
+			return err
+		}
+		//超大帧的后续块
+		if response.continued {
+			continue
+		}
+		if !response.partial && p.opts.codec.IsEndFrame(protocol) {
+			return serverErr
+		}
+		if serverErr == nil && p.opts.codec.IsErrorFrame(protocol) {
+			serverErr = &ServerError{Frame: append([]byte(nil), protocol...)}
+		}
+	}
+}
+
+//onConnect 调用OnConnect，失败时关闭连接
+func (p *ServerProxy) onConnect(client server.Client) error {
+	if p.opts.hooks.OnConnect == nil {
+		return nil
+	}
+	if err := p.opts.hooks.OnConnect(client); err != nil {
+		closeClient(client)
+		return err
+	}
+	return nil
+}
+
+func (p *ServerProxy) onCheckout(client server.Client) {
+	if p.opts.hooks.OnCheckout != nil {
+		p.opts.hooks.OnCheckout(client)
+	}
+}
+
+func (p *ServerProxy) onCheckin(client server.Client) error {
+	if p.opts.hooks.OnCheckin == nil {
+		return nil
+	}
+	return p.opts.hooks.OnCheckin(client)
+}
+
+//discardClient 调用OnDiscard并关闭已经从连接池中删除的连接，err为nil表示是被连接池清理的
+func (p *ServerProxy) discardClient(client server.Client, err error) {
+	if p.opts.hooks.OnDiscard != nil {
+		p.opts.hooks.OnDiscard(client, err)
+	}
+	closeClient(client)
+}
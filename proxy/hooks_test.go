@@ -0,0 +1,206 @@
+package proxy_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+var _ = ginkgo.Describe("Hooks", func() {
+	var s *mockProxyServer
+	var hooks proxy.Hooks
+	var p *proxy.ServerProxy
+	var discarded []error
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: repeatResponse("abc", 10)}
+		discarded = nil
+		hooks = proxy.Hooks{
+			OnDiscard: func(client server.Client, err error) {
+				discarded = append(discarded, err)
+			},
+		}
+	})
+
+	ginkgo.JustBeforeEach(func() {
+		p = proxy.NewProxy(1, s, proxy.WithHooks(hooks))
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("OnConnect initializes the session", func() {
+		var connected int
+
+		ginkgo.BeforeEach(func() {
+			connected = 0
+			s.response = append([][]byte{[]byte("Dset"), []byte("Z")}, s.response...)
+			hooks.OnConnect = func(client server.Client) error {
+				connected++
+				return p.Exec(client, []byte("Qset search_path"))
+			}
+		})
+
+		ginkgo.It("run it once on new connections", func() {
+			for i := 0; i < 2; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(readFirst(response)).To(gomega.Equal("Dabc"))
+			}
+			gomega.Expect(connected).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("OnConnect fails", func() {
+		errInit := errors.New("init failed")
+
+		ginkgo.BeforeEach(func() {
+			hooks.OnConnect = func(server.Client) error {
+				return errInit
+			}
+		})
+
+		ginkgo.It("close the connection and fail the request", func() {
+			_, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.Equal(errInit))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+			gomega.Expect(s.clients[0].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(p.Stats().DialFailures).To(gomega.Equal(int64(0)))
+			gomega.Expect(p.Stats().ClosedHookError).To(gomega.Equal(int64(1)))
+		})
+
+		ginkgo.It("not count OnConnect failures against the backend", func() {
+			q := proxy.NewProxy(1, s, proxy.WithHooks(hooks), proxy.WithCircuitBreaker(proxy.CircuitBreaker{FailureThreshold: 2}))
+			defer q.Close()
+			for i := 0; i < 3; i++ {
+				_, err := q.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.Equal(errInit))
+			}
+		})
+	})
+
+	ginkgo.When("OnCheckout and OnCheckin are set", func() {
+		var checkouts, checkins int
+		var checkinErr error
+
+		ginkgo.BeforeEach(func() {
+			checkouts, checkins, checkinErr = 0, 0, nil
+			hooks.OnCheckout = func(server.Client) {
+				checkouts++
+			}
+			hooks.OnCheckin = func(server.Client) error {
+				checkins++
+				return checkinErr
+			}
+		})
+
+		ginkgo.It("call them for every request", func() {
+			for i := 0; i < 2; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(checkouts).To(gomega.Equal(i + 1))
+				gomega.Expect(checkins).To(gomega.Equal(i))
+				readAll(response)
+				gomega.Expect(checkins).To(gomega.Equal(i + 1))
+			}
+			gomega.Expect(s.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(discarded).To(gomega.BeEmpty())
+		})
+
+		ginkgo.It("discard the connection when OnCheckin fails", func() {
+			checkinErr = errors.New("reset failed")
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+			gomega.Expect(s.clients[0].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(discarded).To(gomega.Equal([]error{checkinErr}))
+			gomega.Expect(p.Stats().ClosedHookError).To(gomega.Equal(int64(1)))
+		})
+
+		ginkgo.It("not count OnCheckin failures against the backend", func() {
+			checkinErr = errors.New("reset failed")
+			q := proxy.NewProxy(1, s, proxy.WithHooks(hooks), proxy.WithCircuitBreaker(proxy.CircuitBreaker{FailureThreshold: 2}))
+			defer q.Close()
+			for i := 0; i < 3; i++ {
+				response, err := q.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				readAll(response)
+			}
+		})
+	})
+
+	ginkgo.It("not check in pre-warmed connections", func() {
+		var connects, checkouts, checkins int32
+		q := proxy.NewProxy(1, s, proxy.WithMinIdle(1), proxy.WithHooks(proxy.Hooks{
+			OnConnect: func(server.Client) error {
+				atomic.AddInt32(&connects, 1)
+				return nil
+			},
+			OnCheckout: func(server.Client) {
+				atomic.AddInt32(&checkouts, 1)
+			},
+			OnCheckin: func(server.Client) error {
+				atomic.AddInt32(&checkins, 1)
+				return nil
+			},
+		}))
+		defer q.Close()
+		gomega.Eventually(q.ClientCount).Should(gomega.Equal(1))
+		gomega.Expect(atomic.LoadInt32(&connects)).To(gomega.Equal(int32(1)))
+		gomega.Expect(atomic.LoadInt32(&checkouts)).To(gomega.Equal(int32(0)))
+		gomega.Consistently(func() int32 {
+			return atomic.LoadInt32(&checkins)
+		}, 20*time.Millisecond).Should(gomega.Equal(int32(0)))
+
+		response, err := q.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+		gomega.Expect(atomic.LoadInt32(&checkouts)).To(gomega.Equal(int32(1)))
+		gomega.Expect(atomic.LoadInt32(&checkins)).To(gomega.Equal(int32(1)))
+	})
+
+	ginkgo.It("tell removed connections from evicted ones", func() {
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+		p.RemoveClient(s.clients[0])
+		gomega.Expect(discarded).To(gomega.HaveLen(1))
+		gomega.Expect(discarded[0]).To(gomega.Equal(proxy.ErrBadConnection))
+
+		response, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+		gomega.Expect(discarded).To(gomega.HaveLen(2))
+		gomega.Expect(discarded[1]).To(gomega.BeNil())
+	})
+
+	ginkgo.It("return server errors from Exec after reading the whole response", func() {
+		frame := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("abc"))
+		end := proxy.AppendLengthPrefixedFrame(nil, 'Z', nil)
+		s.response = [][]byte{proxy.AppendLengthPrefixedFrame(nil, 'E', []byte("boom")), end, frame, end}
+		var execErr error
+		var q *proxy.ServerProxy
+		q = proxy.NewProxy(1, s, proxy.WithCodec(proxy.LengthPrefixedCodec{}), proxy.WithHooks(proxy.Hooks{
+			OnConnect: func(client server.Client) error {
+				execErr = q.Exec(client, proxy.AppendLengthPrefixedFrame(nil, 'Q', []byte("set")))
+				return nil
+			},
+		}))
+		defer q.Close()
+
+		response, err := q.Request(proxy.AppendLengthPrefixedFrame(nil, 'Q', []byte("select")))
+		gomega.Expect(err).To(gomega.BeNil())
+		var serverErr *proxy.ServerError
+		gomega.Expect(errors.As(execErr, &serverErr)).To(gomega.BeTrue())
+		gomega.Expect(serverErr.Frame).To(gomega.Equal(proxy.AppendLengthPrefixedFrame(nil, 'E', []byte("boom"))))
+		gomega.Expect(readFirst(response)).To(gomega.Equal(string(frame)))
+	})
+})
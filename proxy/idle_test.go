@@ -0,0 +1,204 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+//readAll 读完response，连接被回收
+func readAll(response *proxy.Response) {
+	var err error
+	for _, err = response.Read(); err == nil; _, err = response.Read() {
+	}
+	gomega.Expect(err).To(gomega.Equal(io.EOF))
+}
+
+var _ = ginkgo.Describe("Idle eviction", func() {
+	var backend *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		backend = &mockProxyServer{
+			response: [][]byte{
+				[]byte("Daaaaaaaaa"), []byte("Z"),
+				[]byte("Dbbbbbbbbb"), []byte("Z"),
+			},
+		}
+		clock = newFakeClock()
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("max idle time is set", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithMaxIdleTime(time.Minute), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("close clients idle for longer than max idle time", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			clock.Advance(30 * time.Second)
+			gomega.Consistently(p.ClientCount, 20*time.Millisecond).Should(gomega.Equal(1))
+
+			clock.Advance(30 * time.Second)
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(0))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("never close a client in use", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			clock.Advance(2 * time.Minute)
+			ginkgo.By("wait for the reaper to finish a round")
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeFalse())
+
+			readAll(response)
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("max lifetime is set", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithMaxLifetime(time.Minute), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("close an expired client when it is put back", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			clock.Advance(time.Minute)
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+
+			readAll(response)
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+
+			ginkgo.By("next request dial a new client")
+			_, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(len(backend.clients)).To(gomega.Equal(2))
+		})
+
+		ginkgo.It("close an expired idle client in background", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			clock.Advance(time.Minute)
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(0))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.When("an idle client expires between reaper ticks", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(1, backend, proxy.WithMaxLifetime(time.Minute), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("close it at checkout instead of counting it against max client", func() {
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			clock.Advance(30 * time.Second)
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			ginkgo.By("the reaper runs before the client expires")
+			clock.Advance(30 * time.Second)
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+
+			ginkgo.By("the client expires before the next tick")
+			clock.Advance(30 * time.Second)
+			response, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(len(backend.clients)).To(gomega.Equal(2))
+			gomega.Expect(p.Stats().ClosedMaxLifetime).To(gomega.Equal(int64(1)))
+		})
+	})
+
+	ginkgo.When("max idle conns is set", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(3, backend, proxy.WithMaxIdleConns(1), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("close clients put back over the limit", func() {
+			var responses []*proxy.Response
+			for i := 0; i < 3; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				responses = append(responses, response)
+			}
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(3))
+			for _, response := range responses {
+				readAll(response)
+			}
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeFalse())
+			gomega.Expect(backend.clients[1].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(backend.clients[2].isClosed()).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.When("proxy is closed", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(1, backend, proxy.WithMaxIdleTime(time.Minute), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("close clients and reject requests", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+
+			waited := make(chan error, 1)
+			go func() {
+				_, err := p.RequestContext(context.Background(), []byte("Qsecond"))
+				waited <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+
+			gomega.Expect(p.Close()).To(gomega.Succeed())
+			gomega.Eventually(waited).Should(gomega.Receive(gomega.Equal(proxy.ErrProxyClosed)))
+			_, err = p.Request([]byte("Qthird"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrProxyClosed))
+
+			ginkgo.By("client in use is closed when put back")
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeFalse())
+			readAll(response)
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.When("a client is removed", func() {
+		ginkgo.BeforeEach(func() {
+			backend.response = [][]byte{[]byte("bad protocol")}
+			p = proxy.NewProxy(1, backend)
+		})
+
+		ginkgo.It("close the client", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+	})
+})
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//LogLevel 日志级别
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+//日志中的key
+const (
+	//LogKeyBackend 后端的名字
+	LogKeyBackend = "backend"
+	//LogKeyConn 连接的编号，同一个Proxy中唯一
+	LogKeyConn = "conn"
+	//LogKeyQuery 请求的指纹，不会输出请求的内容
+	LogKeyQuery = "query"
+	//LogKeyError 错误
+	LogKeyError = "error"
+	//LogKeyDuration 从请求开始到response结束的时间
+	LogKeyDuration = "duration"
+	//LogKeyFrames 已经返回给调用方的帧数
+	LogKeyFrames = "frames"
+)
+
+//Logger 结构化的日志，keyvals是交替的key和value，比如`"backend", "127.0.0.1:5432", "error", err`
+//不在Proxy的锁内调用，可能被多个goroutine并发调用
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+//stdLogger 使用标准库的log输出logfmt格式的日志
+type stdLogger struct {
+	logger *log.Logger
+	min    LogLevel
+}
+
+//NewStdLogger 使用l输出不低于min级别的日志，格式为`level=warn msg="dial failed" backend=127.0.0.1:5432 error="..."`；l为nil时使用log.Default()
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{logger: l, min: min}
+}
+
+func (s *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < s.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(keyvals[i]))
+		b.WriteByte('=')
+		if i+1 < len(keyvals) {
+			b.WriteString(logfmtValue(keyvals[i+1]))
+		}
+	}
+	s.logger.Print(b.String())
+}
+
+//logfmtValue 格式化一个值，包含空格、引号或者等号时加上引号
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+//fingerprint 请求的指纹，日志中用来关联相同的请求，不泄露请求的内容
+func fingerprint(query []byte) string {
+	h := fnv.New64a()
+	h.Write(query)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+//log 输出日志，没有配置WithLogger时什么都不做
+func (p *ServerProxy) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if p.opts.logger != nil {
+		p.opts.logger.Log(level, msg, keyvals...)
+	}
+}
+
+//logEntry 锁内准备好、锁外输出的一条日志
+type logEntry struct {
+	level   LogLevel
+	msg     string
+	keyvals []interface{}
+}
+
+//connLogEntryLocked 连接相关的一条日志，带上后端、连接编号，以及正在使用连接的请求的指纹和已经持续的时间
+func (p *ServerProxy) connLogEntryLocked(level LogLevel, msg string, client server.Client, err error) *logEntry {
+	info := p.clients[client]
+	keyvals := []interface{}{LogKeyBackend, info.backend.name, LogKeyConn, info.id}
+	if response := p.dependencies[client]; response != nil {
+		keyvals = append(keyvals, LogKeyQuery, response.fingerprint, LogKeyDuration, time.Since(response.start), LogKeyFrames, response.frames)
+	}
+	if err != nil {
+		keyvals = append(keyvals, LogKeyError, err)
+	}
+	return &logEntry{level: level, msg: msg, keyvals: keyvals}
+}
+
+func (p *ServerProxy) emitLog(entry *logEntry) {
+	if entry != nil {
+		p.log(entry.level, entry.msg, entry.keyvals...)
+	}
+}
+
+//removeLogEntryLocked 连接因为err被删除的日志，报文格式错误是Error级别
+func (p *ServerProxy) removeLogEntryLocked(client server.Client, reason closeReason, err error) *logEntry {
+	if reason == closeProtocolError {
+		return p.connLogEntryLocked(LevelError, "protocol violation", client, err)
+	}
+	return p.connLogEntryLocked(LevelWarn, "connection removed", client, err)
+}
+
+//slowLocked response是否超过了WithSlowResponseThreshold
+func (p *ServerProxy) slowLocked(response *Response) bool {
+	return p.opts.logger != nil && p.opts.slowResponse > 0 && time.Since(response.start) >= p.opts.slowResponse
+}
@@ -0,0 +1,130 @@
+package proxy_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+//logRecord 一条日志
+type logRecord struct {
+	level  proxy.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+//recordLogger 记录所有日志
+type recordLogger struct {
+	lock    sync.Mutex
+	records []logRecord
+}
+
+func (l *recordLogger) Log(level proxy.LogLevel, msg string, keyvals ...interface{}) {
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[keyvals[i].(string)] = keyvals[i+1]
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = append(l.records, logRecord{level: level, msg: msg, fields: fields})
+}
+
+func (l *recordLogger) Records() []logRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]logRecord(nil), l.records...)
+}
+
+var _ = ginkgo.Describe("Logger", func() {
+	var s *mockProxyServer
+	var logger *recordLogger
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: [][]byte{[]byte("Dabc"), []byte("Dde"), []byte("Z")}}
+		logger = &recordLogger{}
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("log dial failures", func() {
+		s.failures = 1
+		p = proxy.NewMultiProxy(1, []proxy.Backend{{Name: "primary", Server: s}}, proxy.WithLogger(logger))
+		_, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).NotTo(gomega.BeNil())
+		records := logger.Records()
+		gomega.Expect(records).To(gomega.HaveLen(1))
+		gomega.Expect(records[0].level).To(gomega.Equal(proxy.LevelWarn))
+		gomega.Expect(records[0].msg).To(gomega.Equal("dial failed"))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyBackend, "primary"))
+		gomega.Expect(records[0].fields).To(gomega.HaveKey(proxy.LogKeyError))
+	})
+
+	ginkgo.It("log protocol violations with the connection and query", func() {
+		s.response = [][]byte{[]byte("bad protocol")}
+		p = proxy.NewMultiProxy(1, []proxy.Backend{{Name: "primary", Server: s}}, proxy.WithLogger(logger))
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		_, err = response.Read()
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+
+		records := logger.Records()
+		gomega.Expect(records).To(gomega.HaveLen(1))
+		gomega.Expect(records[0].level).To(gomega.Equal(proxy.LevelError))
+		gomega.Expect(records[0].msg).To(gomega.Equal("protocol violation"))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyBackend, "primary"))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyConn, uint64(1)))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyFrames, 0))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyError, proxy.ErrResponseProtocolFormat))
+		gomega.Expect(records[0].fields[proxy.LogKeyQuery]).NotTo(gomega.BeEmpty())
+
+		ginkgo.By("connections removed by the caller")
+		response, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		p.RemoveClient(s.clients[1])
+		records = logger.Records()
+		gomega.Expect(records).To(gomega.HaveLen(2))
+		gomega.Expect(records[1].level).To(gomega.Equal(proxy.LevelWarn))
+		gomega.Expect(records[1].msg).To(gomega.Equal("connection removed"))
+		gomega.Expect(records[1].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyConn, uint64(2)))
+	})
+
+	ginkgo.It("log slow responses", func() {
+		s.onRead = func() { time.Sleep(5 * time.Millisecond) }
+		p = proxy.NewProxy(1, s, proxy.WithLogger(logger), proxy.WithSlowResponseThreshold(5*time.Millisecond))
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+
+		records := logger.Records()
+		gomega.Expect(records).To(gomega.HaveLen(1))
+		gomega.Expect(records[0].msg).To(gomega.Equal("slow response"))
+		gomega.Expect(records[0].fields).To(gomega.HaveKeyWithValue(proxy.LogKeyFrames, 2))
+		gomega.Expect(records[0].fields[proxy.LogKeyDuration]).To(gomega.BeNumerically(">=", 5*time.Millisecond))
+	})
+
+	ginkgo.It("not log fast responses", func() {
+		p = proxy.NewProxy(1, s, proxy.WithLogger(logger), proxy.WithSlowResponseThreshold(time.Hour))
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+		gomega.Expect(logger.Records()).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("format key/value fields with the std logger", func() {
+		p = proxy.NewProxy(1, s)
+		var buf bytes.Buffer
+		logger := proxy.NewStdLogger(log.New(&buf, "", 0), proxy.LevelWarn)
+		logger.Log(proxy.LevelInfo, "ignored")
+		logger.Log(proxy.LevelWarn, "dial failed", proxy.LogKeyBackend, "a b", proxy.LogKeyConn, 1, proxy.LogKeyError, errors.New("refused"))
+		gomega.Expect(buf.String()).To(gomega.Equal("level=warn msg=\"dial failed\" backend=\"a b\" conn=1 error=refused\n"))
+	})
+})
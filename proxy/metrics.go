@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//metricsContentType Prometheus文本格式
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	//latencyBuckets 延迟直方图的上界，单位是纳秒
+	latencyBuckets = []int64{
+		int64(500 * time.Microsecond), int64(time.Millisecond), int64(2500 * time.Microsecond), int64(5 * time.Millisecond),
+		int64(10 * time.Millisecond), int64(25 * time.Millisecond), int64(50 * time.Millisecond), int64(100 * time.Millisecond),
+		int64(250 * time.Millisecond), int64(500 * time.Millisecond), int64(time.Second), int64(2500 * time.Millisecond),
+		int64(5 * time.Second), int64(10 * time.Second),
+	}
+	//frameSizeBuckets 帧大小直方图的上界，单位是字节
+	frameSizeBuckets = []int64{16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+//outcome 请求的结果
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeBadRequest
+	outcomeClientCountExceeded
+	outcomeProtocolError
+	outcomeError
+)
+
+//outcomeNames 请求结果在metrics中的label
+var outcomeNames = [...]string{"success", "bad_request", "client_count_exceeded", "protocol_error", "error"}
+
+//outcomeOf 请求以err结束的结果，err为nil表示成功
+func outcomeOf(err error) outcome {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case errors.Is(err, ErrBadRequest):
+		return outcomeBadRequest
+	case errors.Is(err, ErrClientCountExceeded):
+		return outcomeClientCountExceeded
+	case errors.Is(err, ErrResponseProtocolFormat) || errors.Is(err, ErrMaxResponseProtocolSizeExceeded):
+		return outcomeProtocolError
+	default:
+		return outcomeError
+	}
+}
+
+//histogram 原子操作的直方图，观测值是整数（纳秒或者字节），输出时除以unit
+type histogram struct {
+	bounds []int64
+	//counts[i]是落在(bounds[i-1], bounds[i]]的次数，最后一个是超过所有上界的次数
+	counts []int64
+	sum    int64
+	count  int64
+	unit   float64
+}
+
+func newHistogram(bounds []int64, unit float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1), unit: unit}
+}
+
+func (h *histogram) observe(v int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, v)
+	atomic.AddInt64(&h.count, 1)
+}
+
+//metrics 请求的计数和直方图，原子操作，不需要持有锁；Response没有Proxy时为nil
+type metrics struct {
+	outcomes   [len(outcomeNames)]int64
+	firstFrame *histogram
+	response   *histogram
+	frameSize  *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		firstFrame: newHistogram(latencyBuckets, float64(time.Second)),
+		response:   newHistogram(latencyBuckets, float64(time.Second)),
+		frameSize:  newHistogram(frameSizeBuckets, 1),
+	}
+}
+
+//finish 请求以err结束，start是请求开始的时间；没有建立Response的请求不记录延迟
+func (m *metrics) finish(err error, start time.Time) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.outcomes[outcomeOf(err)], 1)
+	if !start.IsZero() {
+		m.response.observe(int64(time.Since(start)))
+	}
+}
+
+func (m *metrics) firstFrameAfter(start time.Time) {
+	if m != nil {
+		m.firstFrame.observe(int64(time.Since(start)))
+	}
+}
+
+func (m *metrics) frame(size int) {
+	if m != nil {
+		m.frameSize.observe(int64(size))
+	}
+}
+
+//MetricsHandler 以Prometheus的文本格式输出p的连接池统计、按结果统计的请求数、第一帧和整个response的延迟直方图以及帧大小的直方图
+func MetricsHandler(p *ServerProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		p.WriteMetrics(w)
+	})
+}
+
+//WriteMetrics 以Prometheus的文本格式把metrics写到w
+func (p *ServerProxy) WriteMetrics(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	stats := p.Stats()
+	writeMetric(buf, "tcp_proxy_max_open_connections", "gauge", "Maximum number of backend connections.", float64(stats.MaxOpenConnections))
+	writeMetric(buf, "tcp_proxy_open_connections", "gauge", "Number of established backend connections, in use and idle.", float64(stats.OpenConnections))
+	writeMetric(buf, "tcp_proxy_in_use_connections", "gauge", "Number of backend connections in use.", float64(stats.InUse))
+	writeMetric(buf, "tcp_proxy_idle_connections", "gauge", "Number of idle backend connections.", float64(stats.Idle))
+	writeMetric(buf, "tcp_proxy_dials_total", "counter", "Total number of backend dials, including failed ones.", float64(stats.Dials))
+	writeMetric(buf, "tcp_proxy_dial_failures_total", "counter", "Total number of failed backend dials.", float64(stats.DialFailures))
+
+	writeHeader(buf, "tcp_proxy_connections_closed_total", "counter", "Total number of closed backend connections by reason.")
+	closed := []struct {
+		reason string
+		count  int64
+	}{
+		{"protocol_error", stats.ClosedProtocolError},
+		{"read_error", stats.ClosedReadError},
+		{"idle_timeout", stats.ClosedIdleTimeout},
+		{"max_lifetime", stats.ClosedMaxLifetime},
+		{"max_idle", stats.ClosedMaxIdle},
+		{"hook_error", stats.ClosedHookError},
+		{"other", stats.ClosedOther},
+	}
+	for _, c := range closed {
+		fmt.Fprintf(buf, "tcp_proxy_connections_closed_total{reason=%q} %d\n", c.reason, c.count)
+	}
+
+	writeMetric(buf, "tcp_proxy_waits_total", "counter", "Total number of requests waited for a connection.", float64(stats.WaitCount))
+	writeMetric(buf, "tcp_proxy_wait_seconds_total", "counter", "Total time requests waited for a connection.", stats.WaitDuration.Seconds())
+
+	writeHeader(buf, "tcp_proxy_requests_total", "counter", "Total number of finished requests by outcome.")
+	for i, name := range outcomeNames {
+		fmt.Fprintf(buf, "tcp_proxy_requests_total{outcome=%q} %d\n", name, atomic.LoadInt64(&p.metrics.outcomes[i]))
+	}
+	writeMetric(buf, "tcp_proxy_frames_total", "counter", "Total number of frames relayed to callers.", float64(stats.Frames))
+	writeMetric(buf, "tcp_proxy_received_bytes_total", "counter", "Total number of bytes received from backends.", float64(stats.Bytes))
+
+	writeHistogram(buf, "tcp_proxy_first_frame_seconds", "Time from request to the first frame.", p.metrics.firstFrame)
+	writeHistogram(buf, "tcp_proxy_response_seconds", "Time from request to the end of response.", p.metrics.response)
+	writeHistogram(buf, "tcp_proxy_frame_size_bytes", "Size of frames relayed to callers.", p.metrics.frameSize)
+	return buf.Flush()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value float64) {
+	writeHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	//先读count，并发的观测只会让bucket比count大，不会出现+Inf比其他bucket小的情况
+	count := atomic.LoadInt64(&h.count)
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		if cumulative > count {
+			cumulative = count
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(float64(bound)/h.unit), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(float64(atomic.LoadInt64(&h.sum))/h.unit))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,89 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http/httptest"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+var _ = ginkgo.Describe("Metrics", func() {
+	var s *mockProxyServer
+	var p *proxy.ServerProxy
+
+	//scrape 通过MetricsHandler获得metrics
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		proxy.MetricsHandler(p).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		gomega.Expect(recorder.Header().Get("Content-Type")).To(gomega.HavePrefix("text/plain; version=0.0.4"))
+		body, err := io.ReadAll(recorder.Body)
+		gomega.Expect(err).To(gomega.BeNil())
+		return string(body)
+	}
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: [][]byte{[]byte("Dabc"), []byte("Dde"), []byte("Z")}}
+		p = proxy.NewProxy(1, s)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("render pool gauges in the Prometheus text format", func() {
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		metrics := scrape()
+		gomega.Expect(metrics).To(gomega.ContainSubstring("# TYPE tcp_proxy_open_connections gauge\ntcp_proxy_open_connections 1\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_in_use_connections 1\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_max_open_connections 1\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_dials_total 1\n"))
+		readAll(response)
+		gomega.Expect(scrape()).To(gomega.ContainSubstring("tcp_proxy_idle_connections 1\n"))
+	})
+
+	ginkgo.It("count requests by outcome", func() {
+		_, err := p.Request([]byte("xxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrBadRequest))
+
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		_, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrClientCountExceeded))
+		readAll(response)
+
+		ginkgo.By("a new connection returns a bad protocol")
+		p.RemoveClient(s.clients[0])
+		s.response = [][]byte{[]byte("bad protocol")}
+		response, err = p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		_, err = response.Read()
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+
+		metrics := scrape()
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_requests_total{outcome="success"} 1` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_requests_total{outcome="bad_request"} 1` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_requests_total{outcome="client_count_exceeded"} 1` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_requests_total{outcome="protocol_error"} 1` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_requests_total{outcome="error"} 0` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_connections_closed_total{reason="protocol_error"} 1` + "\n"))
+	})
+
+	ginkgo.It("render latency and frame size histograms", func() {
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+
+		metrics := scrape()
+		gomega.Expect(metrics).To(gomega.ContainSubstring("# TYPE tcp_proxy_first_frame_seconds histogram\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_first_frame_seconds_count 1\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_response_seconds_bucket{le="+Inf"} 1` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_response_seconds_count 1\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_frame_size_bytes_bucket{le="16"} 2` + "\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_frame_size_bytes_sum 7\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring("tcp_proxy_frame_size_bytes_count 2\n"))
+		gomega.Expect(metrics).To(gomega.ContainSubstring(`tcp_proxy_frame_size_bytes_bucket{le="1048576"} 2` + "\n"))
+	})
+})
@@ -1,12 +1,17 @@
 package proxy_test
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/onsi/gomega"
 	"github.com/weenxin/simple-tcp-proxy/proxy"
 	"github.com/weenxin/simple-tcp-proxy/server"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var errClientFailed = errors.New("client failed for unknown reason")
@@ -15,31 +20,94 @@ type clientStatus int8
 
 //mockProxyServer mock一个server
 type mockProxyServer struct {
-	clients  []*mockStringsClient //连接数量
-	response [][]byte             //每个连接都发送同一样的处理逻辑
+	clients   []*mockStringsClient //连接数量
+	response  [][]byte             //每个连接都发送同一样的处理逻辑
+	lock      sync.Mutex           //Connect在proxy锁外调用，可能并发
+	failures  int                  //前failures次连接失败
+	attempts  int                  //连接的次数，包括失败的
+	onRead    func()               //每个连接每次读之前调用，可以用来模拟慢的server
+	onConnect func()               //每次连接之前调用，可以用来模拟慢的建立连接
+	hanging   bool                 //新建的连接读一直阻塞，直到读超时或者被关闭
+	badSend   int                  //前badSend个连接发送请求失败
+	badRead   int                  //接下来的badRead个连接读失败
 }
 
 //Connect 创建一个连接，这个连接的读只会发送server的response数据
 func (s *mockProxyServer) Connect() (server.Client, error) {
-	client := mockStringsClient{status: clientStatusOpen, protocols: s.response}
+	if s.onConnect != nil {
+		s.onConnect()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return nil, server.ErrConnectFailed
+	}
+	if s.hanging {
+		return newMockHangingClient(), nil
+	}
+	client := mockStringsClient{status: clientStatusOpen, protocols: s.response, onRead: s.onRead}
+	if len(s.clients) < s.badSend {
+		client.requestErr = errClientFailed
+	} else if len(s.clients) < s.badSend+s.badRead {
+		client.status = clientStatusFailed
+	}
 	s.clients = append(s.clients, &client)
 	return &client, nil
 }
 
+//Attempts 连接的次数
+func (s *mockProxyServer) Attempts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.attempts
+}
+
+//ClientCount 建立成功的连接数，后台goroutine可能在并发建立连接
+func (s *mockProxyServer) ClientCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
 //mockStringsClient mock一个client
 type mockStringsClient struct {
-	protocols [][]byte     //每次读都会读到一个条目
-	status    clientStatus //暂时没有用起来，用来模拟服务端异常的，设置为failed就不能读到信息，返回错误了
-	index     int          //第几条数据该返回了
+	protocols  [][]byte     //每次读都会读到一个条目
+	status     clientStatus //暂时没有用起来，用来模拟服务端异常的，设置为failed就不能读到信息，返回错误了
+	index      int          //第几条数据该返回了
+	closed     int32        //是否被proxy关闭了，可能在后台清理的goroutine中关闭
+	onRead     func()       //每次读之前调用，可以为nil
+	aliveErr   error        //CheckAlive返回的错误
+	checks     int          //CheckAlive被调用的次数
+	requestErr error        //Request返回的错误
+}
+
+//CheckAlive 返回aliveErr
+func (f *mockStringsClient) CheckAlive() error {
+	f.checks++
+	return f.aliveErr
+}
+
+//Close 记录被关闭了
+func (f *mockStringsClient) Close() error {
+	atomic.StoreInt32(&f.closed, 1)
+	return nil
+}
+
+func (f *mockStringsClient) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) == 1
 }
 
 // 对所有请求都一样长距离，Protocol的有效性由proxy来验证
 func (f mockStringsClient) Request([]byte) error {
-	return nil
+	return f.requestErr
 }
 
 // Read， 返回数据
 func (f *mockStringsClient) Read(data []byte) (int, error) {
+	if f.onRead != nil {
+		f.onRead()
+	}
 
 	if f.status == clientStatusFailed {
 		return 0, errClientFailed
@@ -56,6 +124,74 @@ func (f *mockStringsClient) Read(data []byte) (int, error) {
 	return length, nil
 }
 
+//mockDeadlineClient 读完protocols后一直阻塞直到读超时，模拟一个不再返回数据的server
+type mockDeadlineClient struct {
+	mockStringsClient
+	deadline time.Time
+}
+
+func (c *mockDeadlineClient) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *mockDeadlineClient) Read(data []byte) (int, error) {
+	if c.index < len(c.protocols) {
+		return c.mockStringsClient.Read(data)
+	}
+	if c.deadline.IsZero() {
+		ginkgo.Fail("read without deadline will hang forever")
+	}
+	time.Sleep(time.Until(c.deadline))
+	return 0, fmt.Errorf("read timeout[%w]", server.ErrTimeout)
+}
+
+//mockHangingClient 读一直阻塞，直到读超时或者连接被关闭，模拟一个建立连接之后不再返回数据的server
+type mockHangingClient struct {
+	lock     sync.Mutex
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newMockHangingClient() *mockHangingClient {
+	return &mockHangingClient{closed: make(chan struct{})}
+}
+
+func (c *mockHangingClient) Request([]byte) error {
+	return nil
+}
+
+func (c *mockHangingClient) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *mockHangingClient) Read([]byte) (int, error) {
+	c.lock.Lock()
+	deadline := c.deadline
+	c.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case <-timeout:
+		return 0, fmt.Errorf("read timeout[%w]", server.ErrTimeout)
+	}
+}
+
+func (c *mockHangingClient) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
 //mockProxy 用来测试response对象行为
 type mockProxy struct {
 	clients map[server.Client]bool
@@ -65,6 +201,10 @@ func (p mockProxy) Request(query []byte) (*proxy.Response, error) {
 	return nil, nil
 }
 
+func (p mockProxy) RequestContext(ctx context.Context, query []byte) (*proxy.Response, error) {
+	return nil, nil
+}
+
 func (p mockProxy) PutClient(client server.Client) {
 	p.clients[client] = true
 }
@@ -76,3 +216,60 @@ func (p mockProxy) GetMaxCount() int {
 	//无所谓的，只是用来测试response
 	return 1000
 }
+
+//fakeClock 手动推进的时钟
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+//Advance 推进时间，触发到期的timer
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = timers
+}
+
+//Timers 还没有触发的timer数，用来等待后台goroutine开始下一轮等待
+func (c *fakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
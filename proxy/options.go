@@ -0,0 +1,190 @@
+package proxy
+
+import "time"
+
+//Option 配置ServerProxy和Response，ServerProxy会把自己的配置传给它创建的Response
+type Option func(*options)
+
+type options struct {
+	//报文格式
+	codec Codec
+	//一帧的最大大小，也是每个Response缓存的大小
+	maxFrameSize int
+	//超过maxFrameSize的帧分块交付，而不是返回错误
+	streamLargeFrames bool
+	//Close清空未读报文的超时时间，0表示不超时
+	drainTimeout time.Duration
+	//Close最多清空的字节数，0表示不限制
+	drainLimit int
+	//连接空闲超过这个时间后被关闭，0表示不限制
+	maxIdleTime time.Duration
+	//连接建立超过这个时间后不再复用，0表示不限制
+	maxLifetime time.Duration
+	//最多保留的空闲连接数，0表示不限制
+	maxIdleConns int
+	//至少保持的空闲连接数，0表示不预热
+	minIdle int
+	//空闲连接的健康检查
+	healthCheck HealthCheckConfig
+	//取出空闲连接时的校验，nil表示不校验
+	validation *ValidationConfig
+	//重试策略，nil表示不重试
+	retry *RetryPolicy
+	//多个后端时的负载均衡策略
+	balancer Balancer
+	//异常后端摘除，nil表示不摘除
+	outlier *OutlierDetection
+	//每个后端的熔断器，nil表示不熔断
+	circuitBreaker *CircuitBreaker
+	//日志，nil表示不输出
+	logger Logger
+	//response超过这个时间输出慢日志，0表示不输出
+	slowResponse time.Duration
+	//连接生命周期的回调
+	hooks Hooks
+	//时间来源
+	clock Clock
+}
+
+//minFrameSize 最小的帧大小，至少要放得下长度前缀格式的帧头，否则永远读不出一帧
+const minFrameSize = LengthPrefixedHeaderSize
+
+func newOptions(opts []Option) *options {
+	o := &options{codec: DelimiterCodec{}, maxFrameSize: MaxProtocolLength, clock: systemClock{}, balancer: RoundRobin()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.maxFrameSize < minFrameSize {
+		o.maxFrameSize = minFrameSize
+	}
+	return o
+}
+
+//WithDrainTimeout Response.Close清空未读报文的超时时间，超时后丢弃连接并返回ErrDrainTimeout，0表示不超时
+//client实现了server.DeadlineClient时会设置读超时，否则只能在每次读之后检查
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = timeout
+	}
+}
+
+//WithDrainLimit Response.Close最多清空的字节数，超出后丢弃连接并返回ErrDrainLimitExceeded，0表示不限制
+func WithDrainLimit(limit int) Option {
+	return func(o *options) {
+		o.drainLimit = limit
+	}
+}
+
+//WithCodec 使用codec校验请求和切分protocol，默认是DelimiterCodec
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+//WithMaxFrameSize 一帧的最大大小，也是每个Response缓存的大小，默认MaxProtocolLength；超过时返回ErrMaxResponseProtocolSizeExceeded并丢弃连接
+//小于LengthPrefixedHeaderSize时使用LengthPrefixedHeaderSize
+func WithMaxFrameSize(size int) Option {
+	return func(o *options) {
+		o.maxFrameSize = size
+	}
+}
+
+//WithLargeFrameStreaming 超过最大大小的帧不再返回错误，而是分块交付，通过Response.Partial判断后面还有没有；codec需要实现ChunkCodec
+func WithLargeFrameStreaming() Option {
+	return func(o *options) {
+		o.streamLargeFrames = true
+	}
+}
+
+//WithMaxIdleTime 连接空闲超过d后由后台清理关闭，0表示不限制；可以避免连接比server端的空闲超时活得更久
+func WithMaxIdleTime(d time.Duration) Option {
+	return func(o *options) {
+		o.maxIdleTime = d
+	}
+}
+
+//WithMaxLifetime 连接建立超过d后不再复用：空闲的由后台清理关闭，正在使用的在PutClient时关闭，0表示不限制
+func WithMaxLifetime(d time.Duration) Option {
+	return func(o *options) {
+		o.maxLifetime = d
+	}
+}
+
+//WithMaxIdleConns 最多保留n个空闲连接，PutClient时超出的连接直接关闭，0表示不限制
+func WithMaxIdleConns(n int) Option {
+	return func(o *options) {
+		o.maxIdleConns = n
+	}
+}
+
+//WithMinIdle NewProxy时在后台预先建立n个连接，连接被删除后也在后台补齐，连续建立失败时退避重试；
+//空闲超时不会关闭这n个连接，n不会超过最大连接数和WithMaxIdleConns
+func WithMinIdle(n int) Option {
+	return func(o *options) {
+		o.minIdle = n
+	}
+}
+
+//WithHealthCheck 定时在空闲连接上发送探测请求，删除失败或者太慢的连接，见HealthCheckConfig
+func WithHealthCheck(config HealthCheckConfig) Option {
+	return func(o *options) {
+		o.healthCheck = config
+	}
+}
+
+//WithValidation 从连接池取出空闲连接时先校验，失败的连接被删除，换一个空闲连接或者新建连接，见ValidationConfig
+func WithValidation(config ValidationConfig) Option {
+	return func(o *options) {
+		o.validation = &config
+	}
+}
+
+//WithRetry 请求没有发送成功，或者连接在返回第一帧之前失败时按照policy重试，见RetryPolicy
+func WithRetry(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = &policy
+	}
+}
+
+//WithBalancer NewMultiProxy选择后端的负载均衡策略，默认是RoundRobin
+func WithBalancer(balancer Balancer) Option {
+	return func(o *options) {
+		o.balancer = balancer
+	}
+}
+
+//WithOutlierDetection 连续失败的后端被摘除一段时间，见OutlierDetection；只有一个后端时不会摘除
+func WithOutlierDetection(detection OutlierDetection) Option {
+	return func(o *options) {
+		o.outlier = &detection
+	}
+}
+
+//WithCircuitBreaker 每个后端一个熔断器，见CircuitBreaker；所有后端都熔断时请求返回ErrCircuitOpen
+func WithCircuitBreaker(breaker CircuitBreaker) Option {
+	return func(o *options) {
+		o.circuitBreaker = &breaker
+	}
+}
+
+//WithClock 使用clock获取时间，默认是系统时钟，一般只在测试时使用
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+//WithLogger 输出建立连接失败、连接被删除、报文格式错误和慢response的日志，默认不输出
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+//WithSlowResponseThreshold 从请求开始到response结束超过d时输出慢日志，需要同时配置WithLogger，0表示不输出
+func WithSlowResponseThreshold(d time.Duration) Option {
+	return func(o *options) {
+		o.slowResponse = d
+	}
+}
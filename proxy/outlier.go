@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+const (
+	//defaultConsecutiveErrors 连续失败多少次后摘除后端
+	defaultConsecutiveErrors = 5
+	//defaultBaseEjectionTime 第一次摘除的时间
+	defaultBaseEjectionTime = 30 * time.Second
+	//defaultMaxEjectionTime 摘除时间的上限
+	defaultMaxEjectionTime = 5 * time.Minute
+	//defaultProbeTimeout 探测请求的超时时间
+	defaultProbeTimeout = 5 * time.Second
+)
+
+//OutlierDetection 被动的异常后端摘除：一个后端连续失败（建立连接失败、读写失败、报文格式错误导致连接被删除，调用方清空超限、RemoveClient等不算）达到次数后，
+//在一段时间内不再使用它，时间到了之后新建一个连接探测，成功后恢复，失败则继续摘除，摘除的时间每次翻倍
+//至少保留一个没有被摘除的后端
+type OutlierDetection struct {
+	//ConsecutiveErrors 连续失败多少次后摘除，0表示使用默认值5
+	ConsecutiveErrors int
+	//BaseEjectionTime 第一次摘除的时间，之后每次翻倍，0表示使用默认值30s
+	BaseEjectionTime time.Duration
+	//MaxEjectionTime 摘除时间的上限，恢复后健康超过这个时间，下一次摘除重新从BaseEjectionTime开始；0表示使用默认值5m
+	MaxEjectionTime time.Duration
+	//Query 探测请求，比如`Qping`，会读到结束帧；为nil时只要能建立连接就恢复
+	Query []byte
+	//ProbeTimeout 探测请求的超时时间，超时当作探测失败，0表示使用默认值5s
+	ProbeTimeout time.Duration
+	//OnEvent 摘除和恢复时调用，可以为nil；不在Proxy的锁内调用，但不要阻塞
+	OnEvent func(OutlierEvent)
+}
+
+//OutlierEventType 摘除事件的类型
+type OutlierEventType int
+
+const (
+	//BackendEjected 后端被摘除
+	BackendEjected OutlierEventType = iota
+	//BackendRestored 后端探测成功，恢复使用
+	BackendRestored
+)
+
+func (t OutlierEventType) String() string {
+	if t == BackendEjected {
+		return "ejected"
+	}
+	return "restored"
+}
+
+//OutlierEvent 后端被摘除或者恢复
+type OutlierEvent struct {
+	//Type 摘除还是恢复
+	Type OutlierEventType
+	//Backend 后端的名字
+	Backend string
+	//Time 发生的时间
+	Time time.Time
+	//Duration 摘除的时间，恢复时为0
+	Duration time.Duration
+	//Err 摘除时是最后一次失败的错误，探测失败时是探测的错误
+	Err error
+}
+
+func (o *OutlierDetection) consecutiveErrors() int {
+	if o.ConsecutiveErrors <= 0 {
+		return defaultConsecutiveErrors
+	}
+	return o.ConsecutiveErrors
+}
+
+func (o *OutlierDetection) maxEjectionTime() time.Duration {
+	if o.MaxEjectionTime <= 0 {
+		return defaultMaxEjectionTime
+	}
+	return o.MaxEjectionTime
+}
+
+func (o *OutlierDetection) probeTimeout() time.Duration {
+	if o.ProbeTimeout <= 0 {
+		return defaultProbeTimeout
+	}
+	return o.ProbeTimeout
+}
+
+//ejectionTime 第ejections次摘除的时间
+func (o *OutlierDetection) ejectionTime(ejections int) time.Duration {
+	d, max := o.BaseEjectionTime, o.maxEjectionTime()
+	if d <= 0 {
+		d = defaultBaseEjectionTime
+	}
+	for i := 1; i < ejections && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+//recordSuccessLocked 后端的一次请求成功了，连续失败次数清零，关闭熔断
+func (p *ServerProxy) recordSuccessLocked(b *backend) {
+	b.failures = 0
+	p.circuitSuccessLocked(b)
+}
+
+//recordFailureLocked 后端的一次失败，达到连续失败次数时熔断或者摘除，返回需要在锁外发出的事件
+func (p *ServerProxy) recordFailureLocked(b *backend, err error) *OutlierEvent {
+	p.circuitFailureLocked(b)
+	detection := p.opts.outlier
+	if detection == nil || b.ejected || p.isClosed {
+		return nil
+	}
+	if b.failures++; b.failures < detection.consecutiveErrors() {
+		return nil
+	}
+	//至少保留一个没有被摘除的后端
+	for _, other := range p.backends {
+		if other != b && !other.ejected {
+			return p.ejectLocked(b, err)
+		}
+	}
+	return nil
+}
+
+//ejectLocked 摘除后端，关闭它的空闲连接，并在摘除时间到了之后在后台探测
+func (p *ServerProxy) ejectLocked(b *backend, err error) *OutlierEvent {
+	detection := p.opts.outlier
+	now := p.opts.clock.Now()
+	//恢复后健康了足够长的时间，重新从BaseEjectionTime开始
+	if !b.restoredAt.IsZero() && now.Sub(b.restoredAt) > detection.maxEjectionTime() {
+		b.ejections = 0
+	}
+	b.ejected = true
+	b.failures = 0
+	b.ejections++
+	d := detection.ejectionTime(b.ejections)
+
+	idle := p.deleteIdleClientsLocked(closeOther, func(info *clientInfo) bool {
+		return info.backend == b
+	})
+	p.wg.Add(1)
+	go p.readmit(b, d, idle)
+	return &OutlierEvent{Type: BackendEjected, Backend: b.name, Time: now, Duration: d, Err: err}
+}
+
+//readmit 关闭被摘除后端的空闲连接，等待摘除时间之后探测，成功后恢复，失败则继续摘除
+func (p *ServerProxy) readmit(b *backend, d time.Duration, idle []server.Client) {
+	defer p.wg.Done()
+	for _, client := range idle {
+		p.discardClient(client, nil)
+	}
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.opts.clock.After(d):
+		}
+		err := p.probeBackend(b)
+
+		p.lock.Lock()
+		if p.isClosed {
+			p.lock.Unlock()
+			return
+		}
+		now := p.opts.clock.Now()
+		if err == nil {
+			b.ejected = false
+			b.restoredAt = now
+			//后端又可以新建连接了
+			p.releaseSlotLocked()
+			p.refillLocked()
+			p.lock.Unlock()
+			p.emitOutlierEvent(&OutlierEvent{Type: BackendRestored, Backend: b.name, Time: now})
+			return
+		}
+		b.ejections++
+		d = p.opts.outlier.ejectionTime(b.ejections)
+		p.lock.Unlock()
+		p.emitOutlierEvent(&OutlierEvent{Type: BackendEjected, Backend: b.name, Time: now, Duration: d, Err: err})
+	}
+}
+
+//probeBackend 新建一个探测用的连接，不放入连接池，探测完就关闭；Proxy被关闭时立即关闭连接，不会阻塞Close
+func (p *ServerProxy) probeBackend(b *backend) error {
+	client, err := b.s.Connect()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.stop:
+		case <-done:
+		}
+		closeClient(client)
+	}()
+	if query := p.opts.outlier.Query; query != nil {
+		return p.probe(client, query, p.opts.outlier.probeTimeout())
+	}
+	return nil
+}
+
+//emitOutlierEvent 在锁外调用OnEvent
+func (p *ServerProxy) emitOutlierEvent(event *OutlierEvent) {
+	if event != nil && p.opts.outlier.OnEvent != nil {
+		p.opts.outlier.OnEvent(*event)
+	}
+}
@@ -0,0 +1,220 @@
+package proxy_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+var _ = ginkgo.Describe("Outlier detection", func() {
+	var first, second *mockProxyServer
+	var clock *fakeClock
+	var events chan proxy.OutlierEvent
+	var detection proxy.OutlierDetection
+	var p *proxy.ServerProxy
+
+	//request 发送一个请求并读完，返回第一帧或者错误
+	request := func() (string, error) {
+		response, err := p.Request([]byte("Qxxxxx"))
+		if err != nil {
+			return "", err
+		}
+		protocol, err := response.Read()
+		if err != nil {
+			return "", err
+		}
+		first := string(protocol)
+		readAll(response)
+		return first, nil
+	}
+
+	ginkgo.BeforeEach(func() {
+		first = &mockProxyServer{response: [][]byte{[]byte("bad protocol")}}
+		second = &mockProxyServer{response: repeatResponse("second", 20)}
+		clock = newFakeClock()
+		events = make(chan proxy.OutlierEvent, 10)
+		detection = proxy.OutlierDetection{
+			ConsecutiveErrors: 2,
+			BaseEjectionTime:  30 * time.Second,
+			OnEvent: func(event proxy.OutlierEvent) {
+				events <- event
+			},
+		}
+	})
+
+	ginkgo.JustBeforeEach(func() {
+		//所有请求都读完了，LeastInUse总是优先选择第一个后端
+		p = proxy.NewMultiProxy(4, []proxy.Backend{{Name: "first", Server: first}, {Name: "second", Server: second}},
+			proxy.WithBalancer(proxy.LeastInUse()), proxy.WithOutlierDetection(detection), proxy.WithClock(clock))
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	//ejectFirst 让第一个后端连续失败两次被摘除
+	ejectFirst := func() {
+		for i := 0; i < 2; i++ {
+			_, err := request()
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+		}
+		var event proxy.OutlierEvent
+		gomega.Eventually(events).Should(gomega.Receive(&event))
+		gomega.Expect(event.Type).To(gomega.Equal(proxy.BackendEjected))
+		gomega.Expect(event.Backend).To(gomega.Equal("first"))
+		gomega.Expect(event.Duration).To(gomega.Equal(30 * time.Second))
+	}
+
+	ginkgo.It("eject the backend after consecutive errors", func() {
+		ejectFirst()
+		for i := 0; i < 3; i++ {
+			served, err := request()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(served).To(gomega.Equal("Dsecond"))
+		}
+		gomega.Expect(first.ClientCount()).To(gomega.Equal(2))
+	})
+
+	ginkgo.It("restore the backend after a successful probe", func() {
+		ejectFirst()
+		first.response = repeatResponse("first", 20)
+		gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+		clock.Advance(30 * time.Second)
+
+		var event proxy.OutlierEvent
+		gomega.Eventually(events).Should(gomega.Receive(&event))
+		gomega.Expect(event.Type).To(gomega.Equal(proxy.BackendRestored))
+		ginkgo.By("the probe client is closed")
+		gomega.Expect(first.ClientCount()).To(gomega.Equal(3))
+		gomega.Expect(first.clients[2].isClosed()).To(gomega.BeTrue())
+
+		served, err := request()
+		gomega.Expect(err).To(gomega.BeNil())
+		gomega.Expect(served).To(gomega.Equal("Dfirst"))
+	})
+
+	ginkgo.It("eject again for a doubled time when the probe failed", func() {
+		ejectFirst()
+		first.failures = 100
+		gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+		clock.Advance(30 * time.Second)
+
+		var event proxy.OutlierEvent
+		gomega.Eventually(events).Should(gomega.Receive(&event))
+		gomega.Expect(event.Type).To(gomega.Equal(proxy.BackendEjected))
+		gomega.Expect(event.Duration).To(gomega.Equal(time.Minute))
+		gomega.Expect(errors.Is(event.Err, server.ErrConnectFailed)).To(gomega.BeTrue())
+
+		gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+		clock.Advance(30 * time.Second)
+		gomega.Consistently(events, 20*time.Millisecond).ShouldNot(gomega.Receive())
+		clock.Advance(30 * time.Second)
+		gomega.Eventually(events).Should(gomega.Receive(&event))
+		gomega.Expect(event.Duration).To(gomega.Equal(2 * time.Minute))
+	})
+
+	ginkgo.When("the ejected backend accepts connections but never answers", func() {
+		ginkgo.BeforeEach(func() {
+			detection.Query = []byte("Qping")
+			detection.ProbeTimeout = 20 * time.Millisecond
+		})
+
+		//hangFirst 摘除第一个后端，之后它的连接都不再返回数据
+		hangFirst := func() {
+			ejectFirst()
+			first.lock.Lock()
+			first.hanging = true
+			first.lock.Unlock()
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+		}
+
+		ginkgo.It("fail the probe after the probe timeout", func() {
+			hangFirst()
+			clock.Advance(30 * time.Second)
+			var event proxy.OutlierEvent
+			gomega.Eventually(events).Should(gomega.Receive(&event))
+			gomega.Expect(event.Type).To(gomega.Equal(proxy.BackendEjected))
+			gomega.Expect(event.Duration).To(gomega.Equal(time.Minute))
+			gomega.Expect(errors.Is(event.Err, proxy.ErrHealthCheckTimeout)).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("not block Close on a probe in flight", func() {
+			detection.ProbeTimeout = time.Hour
+			p.Close()
+			p = proxy.NewMultiProxy(4, []proxy.Backend{{Name: "first", Server: first}, {Name: "second", Server: second}},
+				proxy.WithBalancer(proxy.LeastInUse()), proxy.WithOutlierDetection(detection), proxy.WithClock(clock))
+			hangFirst()
+			clock.Advance(30 * time.Second)
+			gomega.Eventually(first.Attempts).Should(gomega.Equal(3))
+
+			closed := make(chan struct{})
+			go func() {
+				p.Close()
+				close(closed)
+			}()
+			gomega.Eventually(closed, time.Second).Should(gomega.BeClosed())
+		})
+	})
+
+	ginkgo.When("requests succeed between errors", func() {
+		ginkgo.BeforeEach(func() {
+			//每个连接第一个请求成功，第二个请求报文格式错误
+			first.response = [][]byte{[]byte("Dfirst"), []byte("Z"), []byte("bad protocol")}
+		})
+
+		ginkgo.It("never eject the backend", func() {
+			for i := 0; i < 3; i++ {
+				served, err := request()
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(served).To(gomega.Equal("Dfirst"))
+				_, err = request()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+			}
+			gomega.Consistently(events, 20*time.Millisecond).ShouldNot(gomega.Receive())
+		})
+	})
+
+	ginkgo.When("the caller removes connections", func() {
+		ginkgo.BeforeEach(func() {
+			first.response = repeatResponse("first", 20)
+		})
+
+		ginkgo.It("never eject the backend", func() {
+			q := proxy.NewMultiProxy(4, []proxy.Backend{{Name: "first", Server: first}, {Name: "second", Server: second}},
+				proxy.WithBalancer(proxy.LeastInUse()), proxy.WithOutlierDetection(detection), proxy.WithClock(clock),
+				proxy.WithDrainLimit(4))
+			defer q.Close()
+			for i := 0; i < 3; i++ {
+				response, err := q.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(response.Close()).To(gomega.Equal(proxy.ErrDrainLimitExceeded))
+			}
+			for i := 0; i < 3; i++ {
+				response, err := q.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				readAll(response)
+				q.RemoveClient(first.clients[len(first.clients)-1])
+			}
+			gomega.Consistently(events, 20*time.Millisecond).ShouldNot(gomega.Receive())
+			gomega.Expect(second.ClientCount()).To(gomega.Equal(0))
+		})
+	})
+
+	ginkgo.When("there is only one backend", func() {
+		ginkgo.It("never eject it", func() {
+			single := proxy.NewProxy(1, first, proxy.WithOutlierDetection(detection), proxy.WithClock(clock))
+			defer single.Close()
+			for i := 0; i < 3; i++ {
+				response, err := single.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				_, err = response.Read()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+			}
+			gomega.Consistently(events, 20*time.Millisecond).ShouldNot(gomega.Receive())
+		})
+	})
+})
@@ -2,6 +2,10 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
 )
 
 const (
@@ -10,12 +14,209 @@ const (
 	RequestStartChar  = 'Q'
 )
 
+const (
+	//DefaultCodecName 默认Codec的名字，也就是`Q`/`D`/`Z`分隔的报文格式
+	DefaultCodecName = "delimiter"
+	//LengthPrefixedCodecName 类型+长度的报文格式
+	LengthPrefixedCodecName = "length-prefixed"
+)
+
+const (
+	//ErrorFrameChar 长度前缀格式中的错误帧
+	ErrorFrameChar = 'E'
+	//LengthPrefixedHeaderSize 长度前缀格式的帧头：一个字节的类型+4个字节的长度
+	LengthPrefixedHeaderSize = 5
+)
+
+//ErrServerError server端返回了错误帧
+var ErrServerError = errors.New("server response error frame")
+
+//Codec 与server之间的报文格式，ServerProxy和Response通过Codec校验请求、切分protocol
+//Codec会被多个Response并发使用，实现不能有状态
+type Codec interface {
+	//ValidateRequest 校验用户请求，不合法时返回ErrBadRequest（或者包装了ErrBadRequest的错误）
+	ValidateRequest(query []byte) error
+	//SplitFrame 从data开头切出一个完整的protocol，返回data中的片段，不会新建和copy；数据还不够一个protocol时返回nil, nil
+	SplitFrame(data []byte) ([]byte, error)
+	//IsEndFrame 是否是最后一帧，代表response结束
+	IsEndFrame(frame []byte) bool
+	//IsErrorFrame 是否是server端返回的错误帧
+	IsErrorFrame(frame []byte) bool
+}
+
+//ChunkCodec 可选接口，Codec实现了它才能通过WithLargeFrameStreaming把放不进缓存的帧分块交付
+type ChunkCodec interface {
+	Codec
+	//FirstChunk 缓存已满但SplitFrame还不够一帧时调用，data是整个缓存，会作为第一块交付；返回这一帧还剩多少字节没有收到，不知道时返回-1
+	FirstChunk(data []byte) (remaining int, err error)
+	//NextChunk 从后续数据中切出这一帧的下一块，remaining是上一块返回的剩余字节数；final表示这一帧结束了，后面是下一帧
+	NextChunk(data []byte, remaining int) (chunk []byte, next int, final bool)
+}
+
+//ServerError server端返回的错误帧，Response.Read返回这个错误后response并没有结束，可以继续读到io.EOF或者直接Close
+type ServerError struct {
+	//Frame 错误帧，是一份copy
+	Frame []byte
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrServerError.Error(), e.Frame)
+}
+
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServerError
+}
+
+//DelimiterCodec 默认的报文格式：请求以`Q`开头，每个protocol以`D`开头，response以单独的`Z`结束，没有错误帧
+type DelimiterCodec struct{}
+
+func (DelimiterCodec) ValidateRequest(query []byte) error {
+	if len(query) == 0 || !IsGoodRequest(query) {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+func (DelimiterCodec) SplitFrame(data []byte) ([]byte, error) {
+	//缓存是否满了由Response判断，缓存大小可以配置
+	return splitProtocol(data)
+}
+
+func (DelimiterCodec) IsEndFrame(frame []byte) bool {
+	return IsEndResponse(frame)
+}
+
+func (DelimiterCodec) IsErrorFrame(frame []byte) bool {
+	return false
+}
+
+//FirstChunk 不知道帧有多长，只能等到下一个`D`或者`Z`
+func (DelimiterCodec) FirstChunk(data []byte) (int, error) {
+	if data[0] != byte(ProtocolStartChar) {
+		return 0, ErrResponseProtocolFormat
+	}
+	return -1, nil
+}
+
+func (DelimiterCodec) NextChunk(data []byte, remaining int) ([]byte, int, bool) {
+	if index := bytes.IndexAny(data, string([]byte{ProtocolStartChar, ResponseEndChar})); index >= 0 {
+		return data[:index], -1, true
+	}
+	return data, -1, false
+}
+
+//LengthPrefixedCodec 类型+长度的报文格式，和PostgreSQL的消息格式一样：一个字节的类型，4个字节大端的长度（包括长度自己，不包括类型），然后是内容
+//请求类型是`Q`，protocol类型是`D`，`Z`结束，`E`是错误帧。因为按长度切分，内容中可以包含任意字节
+type LengthPrefixedCodec struct{}
+
+func (LengthPrefixedCodec) ValidateRequest(query []byte) error {
+	if len(query) < LengthPrefixedHeaderSize || query[0] != byte(RequestStartChar) {
+		return ErrBadRequest
+	}
+	if int(binary.BigEndian.Uint32(query[1:LengthPrefixedHeaderSize])) != len(query)-1 {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+func (LengthPrefixedCodec) SplitFrame(data []byte) ([]byte, error) {
+	if len(data) < LengthPrefixedHeaderSize {
+		return nil, nil
+	}
+	switch data[0] {
+	case ProtocolStartChar, ResponseEndChar, ErrorFrameChar:
+	default:
+		return nil, ErrResponseProtocolFormat
+	}
+	length := int(binary.BigEndian.Uint32(data[1:LengthPrefixedHeaderSize]))
+	if length < LengthPrefixedHeaderSize-1 {
+		return nil, ErrResponseProtocolFormat
+	}
+	if len(data) < length+1 {
+		return nil, nil
+	}
+	return data[:length+1], nil
+}
+
+func (LengthPrefixedCodec) IsEndFrame(frame []byte) bool {
+	return frame[0] == byte(ResponseEndChar)
+}
+
+func (LengthPrefixedCodec) IsErrorFrame(frame []byte) bool {
+	return frame[0] == byte(ErrorFrameChar)
+}
+
+//FirstChunk 根据帧头中的长度计算还剩多少字节，帧头已经由SplitFrame校验过了；放不下帧头时返回ErrMaxResponseProtocolSizeExceeded
+func (LengthPrefixedCodec) FirstChunk(data []byte) (int, error) {
+	if len(data) < LengthPrefixedHeaderSize {
+		return 0, ErrMaxResponseProtocolSizeExceeded
+	}
+	length := int(binary.BigEndian.Uint32(data[1:LengthPrefixedHeaderSize]))
+	return length + 1 - len(data), nil
+}
+
+func (LengthPrefixedCodec) NextChunk(data []byte, remaining int) ([]byte, int, bool) {
+	if len(data) >= remaining {
+		return data[:remaining], 0, true
+	}
+	return data, remaining - len(data), false
+}
+
+//AppendLengthPrefixedFrame 把一个类型为typ的长度前缀帧追加到dst
+func AppendLengthPrefixedFrame(dst []byte, typ byte, payload []byte) []byte {
+	var header [LengthPrefixedHeaderSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)+LengthPrefixedHeaderSize-1))
+	dst = append(dst, header[:]...)
+	return append(dst, payload...)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{
+	m: map[string]Codec{
+		DefaultCodecName:        DelimiterCodec{},
+		LengthPrefixedCodecName: LengthPrefixedCodec{},
+	},
+}
+
+//RegisterCodec 注册一个Codec，名字重复时panic，和database/sql.Register一样
+func RegisterCodec(name string, codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	if codec == nil {
+		panic("proxy: register codec is nil")
+	}
+	if _, exists := codecs.m[name]; exists {
+		panic("proxy: register codec twice for " + name)
+	}
+	codecs.m[name] = codec
+}
+
+//GetCodec 获取已经注册的Codec
+func GetCodec(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, exists := codecs.m[name]
+	return codec, exists
+}
+
 func IsGoodRequest(data []byte) bool {
 	return data[0] == byte(RequestStartChar)
 }
 
 //FormatProtocol 封装一个数据包，返回数据包在 data 数据中的片段，不会新建和copy
 func FormatProtocol(data []byte) ([]byte, error) {
+	protocol, err := splitProtocol(data)
+	if protocol == nil && err == nil && len(data) == MaxProtocolLength {
+		return nil, ErrMaxResponseProtocolSizeExceeded
+	}
+	return protocol, err
+}
+
+//splitProtocol 按照`D`和`Z`切分出一个数据包，数据不够时返回nil, nil
+func splitProtocol(data []byte) ([]byte, error) {
 	//结束 data 只有一个字节
 	if data[0] == byte(ResponseEndChar) {
 		return data[0:1], nil
@@ -31,10 +232,6 @@ func FormatProtocol(data []byte) ([]byte, error) {
 		return data[:index+1], nil
 	}
 
-	if len(data) == MaxProtocolLength {
-		return nil, ErrMaxResponseProtocolSizeExceeded
-	}
-
 	//其实这里还是可以改进的，如果server端一定是一个完整的protocol发送，那么即使没有找到Z或者D，说明刚好收到一包数据。
 	return nil, nil
 }
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//chunkClient 每次最多返回size个字节，模拟任意的TCP分包
+type chunkClient struct {
+	data []byte
+	size int
+}
+
+func (c *chunkClient) Request([]byte) error {
+	return nil
+}
+
+func (c *chunkClient) Read(data []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := c.size
+	if n > len(c.data) {
+		n = len(c.data)
+	}
+	n = copy(data, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+//readPayloads 读取所有的protocol，去掉帧头后返回
+func readPayloads(stream []byte, size int, codec proxy.Codec, headerSize int) ([][]byte, error) {
+	client := &chunkClient{data: stream, size: size}
+	response := proxy.NewResponse(client, mockProxy{clients: make(map[server.Client]bool)}, proxy.WithCodec(codec))
+	var payloads [][]byte
+	for {
+		frame, err := response.Read()
+		if err == io.EOF {
+			return payloads, nil
+		}
+		if err != nil {
+			return payloads, err
+		}
+		payloads = append(payloads, append([]byte{}, frame[headerSize:]...))
+	}
+}
+
+//FuzzFraming 同样的一组payload分别用两种格式编码，任意分包后读出来比较：
+//长度前缀格式总是能还原payload；`D`/`Z`分隔的格式只保证payload中没有`D`和`Z`时能还原
+func FuzzFraming(f *testing.F) {
+	f.Add([]byte("first\x00second"), uint8(3))
+	f.Add([]byte("row with D\x00and Z"), uint8(1))
+	f.Add([]byte("\x00\x00"), uint8(7))
+	f.Add([]byte("DDDD\x00ZZZZ"), uint8(255))
+
+	f.Fuzz(func(t *testing.T, input []byte, size uint8) {
+		if len(input) > 1024 || size == 0 {
+			t.Skip()
+		}
+		payloads := bytes.Split(input, []byte{0})
+
+		var delimited, prefixed []byte
+		for _, payload := range payloads {
+			delimited = append(delimited, proxy.ProtocolStartChar)
+			delimited = append(delimited, payload...)
+			prefixed = proxy.AppendLengthPrefixedFrame(prefixed, proxy.ProtocolStartChar, payload)
+		}
+		delimited = append(delimited, proxy.ResponseEndChar)
+		prefixed = proxy.AppendLengthPrefixedFrame(prefixed, proxy.ResponseEndChar, nil)
+
+		got, err := readPayloads(prefixed, int(size), proxy.LengthPrefixedCodec{}, proxy.LengthPrefixedHeaderSize)
+		if err != nil {
+			t.Fatalf("length prefixed read failed: %v", err)
+		}
+		if !equalPayloads(got, payloads) {
+			t.Fatalf("length prefixed got %q, want %q", got, payloads)
+		}
+
+		//payload中有`D`或者`Z`时，分隔格式的结果是不确定的，只要求不panic、不挂住
+		got, err = readPayloads(delimited, int(size), proxy.DelimiterCodec{}, 1)
+		if !bytes.ContainsAny(input, "DZ") && (err != nil || !equalPayloads(got, payloads)) {
+			t.Fatalf("delimiter got %q %v, want %q", got, err, payloads)
+		}
+	})
+}
+
+func equalPayloads(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
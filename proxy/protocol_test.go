@@ -0,0 +1,255 @@
+package proxy_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+//lineCodec 一个按行切分的Codec：请求以`?`开头，每行一个protocol，`.`结束，`-`开头的是错误
+type lineCodec struct{}
+
+func (lineCodec) ValidateRequest(query []byte) error {
+	if len(query) == 0 || query[0] != '?' {
+		return proxy.ErrBadRequest
+	}
+	return nil
+}
+
+func (lineCodec) SplitFrame(data []byte) ([]byte, error) {
+	if index := bytes.IndexByte(data, '\n'); index >= 0 {
+		return data[:index+1], nil
+	}
+	return nil, nil
+}
+
+func (lineCodec) IsEndFrame(frame []byte) bool {
+	return string(frame) == ".\n"
+}
+
+func (lineCodec) IsErrorFrame(frame []byte) bool {
+	return frame[0] == '-'
+}
+
+func init() {
+	proxy.RegisterCodec("line", lineCodec{})
+}
+
+var _ = ginkgo.Describe("Codec", func() {
+
+	ginkgo.Describe("DelimiterCodec", func() {
+		codec := proxy.DelimiterCodec{}
+
+		ginkgo.It("validate request start with 'Q'", func() {
+			gomega.Expect(codec.ValidateRequest([]byte("Qxxx"))).To(gomega.Succeed())
+			gomega.Expect(codec.ValidateRequest([]byte("xxx"))).To(gomega.Equal(proxy.ErrBadRequest))
+			gomega.Expect(codec.ValidateRequest(nil)).To(gomega.Equal(proxy.ErrBadRequest))
+		})
+
+		ginkgo.It("split frame like FormatProtocol", func() {
+			frame, err := codec.SplitFrame([]byte("DaaaDbbb"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(frame)).To(gomega.Equal("Daaa"))
+
+			frame, err = codec.SplitFrame([]byte("Daaa"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(frame).To(gomega.BeNil())
+
+			_, err = codec.SplitFrame([]byte("xaaa"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+		})
+
+		ginkgo.It("split large frame into chunks until next 'D' or 'Z'", func() {
+			remaining, err := codec.FirstChunk([]byte("Daaaa"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			chunk, remaining, final := codec.NextChunk([]byte("aaaa"), remaining)
+			gomega.Expect(string(chunk)).To(gomega.Equal("aaaa"))
+			gomega.Expect(final).To(gomega.BeFalse())
+			chunk, _, final = codec.NextChunk([]byte("aaDbb"), remaining)
+			gomega.Expect(string(chunk)).To(gomega.Equal("aa"))
+			gomega.Expect(final).To(gomega.BeTrue())
+
+			_, err = codec.FirstChunk([]byte("xaaaa"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+		})
+
+		ginkgo.It("only a single 'Z' is the end", func() {
+			gomega.Expect(codec.IsEndFrame([]byte("Z"))).To(gomega.BeTrue())
+			gomega.Expect(codec.IsEndFrame([]byte("Daaa"))).To(gomega.BeFalse())
+			gomega.Expect(codec.IsErrorFrame([]byte("Daaa"))).To(gomega.BeFalse())
+		})
+	})
+
+	ginkgo.Describe("LengthPrefixedCodec", func() {
+		codec := proxy.LengthPrefixedCodec{}
+
+		ginkgo.It("validate request type and length", func() {
+			gomega.Expect(codec.ValidateRequest(proxy.AppendLengthPrefixedFrame(nil, 'Q', []byte("select")))).To(gomega.Succeed())
+			gomega.Expect(codec.ValidateRequest(proxy.AppendLengthPrefixedFrame(nil, 'X', []byte("select")))).To(gomega.Equal(proxy.ErrBadRequest))
+			gomega.Expect(codec.ValidateRequest([]byte("Qselect"))).To(gomega.Equal(proxy.ErrBadRequest))
+			gomega.Expect(codec.ValidateRequest([]byte("Q"))).To(gomega.Equal(proxy.ErrBadRequest))
+		})
+
+		ginkgo.It("split frame by length even if payload contains 'D' and 'Z'", func() {
+			data := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("aDbZc"))
+			data = proxy.AppendLengthPrefixedFrame(data, 'Z', nil)
+
+			frame, err := codec.SplitFrame(data)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(frame).To(gomega.Equal(proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("aDbZc"))))
+			gomega.Expect(codec.IsEndFrame(frame)).To(gomega.BeFalse())
+
+			frame, err = codec.SplitFrame(data[len(frame):])
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(codec.IsEndFrame(frame)).To(gomega.BeTrue())
+		})
+
+		ginkgo.It("wait for more data when the frame is not complete", func() {
+			data := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("aaaa"))
+			for i := 0; i < len(data); i++ {
+				frame, err := codec.SplitFrame(data[:i])
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(frame).To(gomega.BeNil())
+			}
+		})
+
+		ginkgo.It("return error for bad type and bad length", func() {
+			_, err := codec.SplitFrame(proxy.AppendLengthPrefixedFrame(nil, 'X', nil))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+			_, err = codec.SplitFrame([]byte{'D', 0, 0, 0, 1})
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+		})
+
+		ginkgo.It("split large frame into chunks", func() {
+			data := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("aaaaaaaaaa"))
+			remaining, err := codec.FirstChunk(data[:8])
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(remaining).To(gomega.Equal(len(data) - 8))
+
+			chunk, remaining, final := codec.NextChunk(data[8:12], remaining)
+			gomega.Expect(string(chunk)).To(gomega.Equal("aaaa"))
+			gomega.Expect(final).To(gomega.BeFalse())
+			chunk, _, final = codec.NextChunk(append(data[12:], 'Z'), remaining)
+			gomega.Expect(string(chunk)).To(gomega.Equal("aaa"))
+			gomega.Expect(final).To(gomega.BeTrue())
+
+			_, err = codec.FirstChunk(data[:4])
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrMaxResponseProtocolSizeExceeded))
+		})
+
+		ginkgo.It("detect error frame", func() {
+			gomega.Expect(codec.IsErrorFrame(proxy.AppendLengthPrefixedFrame(nil, 'E', []byte("oops")))).To(gomega.BeTrue())
+			gomega.Expect(codec.IsErrorFrame(proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("oops")))).To(gomega.BeFalse())
+		})
+	})
+
+	ginkgo.Describe("registry", func() {
+		ginkgo.It("has the default codec", func() {
+			codec, exists := proxy.GetCodec(proxy.DefaultCodecName)
+			gomega.Expect(exists).To(gomega.BeTrue())
+			gomega.Expect(codec).To(gomega.Equal(proxy.DelimiterCodec{}))
+		})
+
+		ginkgo.It("has the length prefixed codec", func() {
+			codec, exists := proxy.GetCodec(proxy.LengthPrefixedCodecName)
+			gomega.Expect(exists).To(gomega.BeTrue())
+			gomega.Expect(codec).To(gomega.Equal(proxy.LengthPrefixedCodec{}))
+		})
+
+		ginkgo.It("return registered codec", func() {
+			codec, exists := proxy.GetCodec("line")
+			gomega.Expect(exists).To(gomega.BeTrue())
+			gomega.Expect(codec).To(gomega.Equal(lineCodec{}))
+
+			_, exists = proxy.GetCodec("unknown")
+			gomega.Expect(exists).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("panic when register twice", func() {
+			gomega.Expect(func() {
+				proxy.RegisterCodec("line", lineCodec{})
+			}).To(gomega.Panic())
+		})
+	})
+
+	ginkgo.Describe("proxy with a custom codec", func() {
+		var p *proxy.ServerProxy
+
+		ginkgo.BeforeEach(func() {
+			s := &mockProxyServer{
+				response: [][]byte{[]byte("+a\n+b"), []byte("\n-oops\n"), []byte(".\n")},
+			}
+			codec, _ := proxy.GetCodec("line")
+			p = proxy.NewProxy(5, s, proxy.WithCodec(codec))
+		})
+
+		ginkgo.It("validate request with the codec", func() {
+			response, err := p.Request([]byte("Qxxx"))
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrBadRequest))
+			gomega.Expect(response).To(gomega.BeNil())
+		})
+
+		ginkgo.It("split frames, report error frame and end with the codec", func() {
+			response, err := p.Request([]byte("?xxx"))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			data, err := response.Read()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("+a\n"))
+			data, err = response.Read()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("+b\n"))
+
+			ginkgo.By("error frame does not end the response")
+			data, err = response.Read()
+			gomega.Expect(data).To(gomega.BeNil())
+			gomega.Expect(errors.Is(err, proxy.ErrServerError)).To(gomega.BeTrue())
+			var serverErr *proxy.ServerError
+			gomega.Expect(errors.As(err, &serverErr)).To(gomega.BeTrue())
+			gomega.Expect(string(serverErr.Frame)).To(gomega.Equal("-oops\n"))
+			gomega.Expect(response.IsClosed()).To(gomega.BeFalse())
+
+			ginkgo.By("end frame")
+			data, err = response.Read()
+			gomega.Expect(err).To(gomega.Equal(io.EOF))
+			gomega.Expect(data).To(gomega.BeNil())
+			gomega.Expect(string(response.Trailer())).To(gomega.Equal(".\n"))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+	ginkgo.Describe("proxy with length prefixed codec", func() {
+		var p *proxy.ServerProxy
+		first := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("row with D and Z"))
+		second := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("ZZZ"))
+
+		ginkgo.BeforeEach(func() {
+			stream := append(append([]byte{}, first...), second...)
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'Z', nil)
+			s := &mockProxyServer{
+				//故意切碎
+				response: [][]byte{stream[:3], stream[3:12], stream[12:30], stream[30:]},
+			}
+			p = proxy.NewProxy(5, s, proxy.WithCodec(proxy.LengthPrefixedCodec{}))
+		})
+
+		ginkgo.It("return whole frames regardless of content", func() {
+			response, err := p.Request(proxy.AppendLengthPrefixedFrame(nil, 'Q', []byte("select")))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+			data, err := response.Read()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(data).To(gomega.Equal(first))
+			data, err = response.Read()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(data).To(gomega.Equal(second))
+			data, err = response.Read()
+			gomega.Expect(err).To(gomega.Equal(io.EOF))
+			gomega.Expect(data).To(gomega.BeNil())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+})
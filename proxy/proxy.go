@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/weenxin/simple-tcp-proxy/server"
 	"sync"
+	"time"
 )
 
 var (
@@ -13,6 +16,7 @@ var (
 	ErrBadConnection                   = errors.New("bad connection, server error")
 	ErrMaxResponseProtocolSizeExceeded = errors.New("server response protocol max size Exceeded")
 	ErrResponseProtocolFormat          = errors.New("server response protocol not start with 'D' and end with 'Z'")
+	ErrProxyClosed                     = errors.New("proxy closed")
 )
 
 //Proxy 是proxy的性能抽象，部分接口没有开放，可以按需开放
@@ -25,133 +29,521 @@ type Proxy interface {
 	GetMaxCount() int
 	//Request 新建请求
 	Request(query []byte) (*Response, error)
+	//RequestContext 新建请求，连接数已满时排队等待
+	RequestContext(ctx context.Context, query []byte) (*Response, error)
+}
+
+const (
+	//minReapInterval 后台清理的最小间隔，避免配置的时间太短时一直占用锁
+	minReapInterval = time.Second
+	//minRefillBackoff 后台补齐连接失败后第一次重试的等待时间，之后每次翻倍
+	minRefillBackoff = 100 * time.Millisecond
+	//maxRefillBackoff 后台补齐连接失败后重试的最长等待时间
+	maxRefillBackoff = 30 * time.Second
+)
+
+//connRequest 交给排队请求的连接，client为nil时表示交给它一个在backend上新建连接的名额；err不为nil时表示不用再等了
+type connRequest struct {
+	client  server.Client
+	backend *backend
+	err     error
+}
+
+//clientInfo 连接的元信息
+type clientInfo struct {
+	//建立时间，用来判断是否超过最大生命周期
+	createdAt time.Time
+	//最后一次回收的时间，空闲时间从这里开始算
+	returnedAt time.Time
+	//最后一次健康检查的时间
+	checkedAt time.Time
+	//连接所属的后端
+	backend *backend
+	//连接的编号，用于日志
+	id uint64
 }
 
 //ServerProxy 一份Proxy实例
 type ServerProxy struct {
+	//统计，原子操作；放在第一个，保证32位平台上64位的原子操作是对齐的
+	stats stats
 	//是否有client依赖，client在dependencies存在时表示有Response依赖与它，不能复用；当Response全部读取完成后自动释放依赖
 	dependencies map[server.Client]*Response
 	//当前的连接
-	clients map[server.Client]struct{}
-	//最大连接数
+	clients map[server.Client]*clientInfo
+	//最大连接数，所有后端的总和
 	maxClient int
-	//后端的server
-	s server.Server
+	//后端
+	backends []*backend
+	//配置
+	opts *options
+	//排队等待连接的请求，先进先出，元素为chan connRequest
+	waiters *list.List
+	//已经交给排队请求、但还没有建立的连接数，也占用最大连接数
+	pending int
+	//至少保持的空闲连接数
+	minIdle int
+	//通知后台补齐空闲连接
+	refill chan struct{}
+	//是否已经关闭
+	isClosed bool
+	//关闭时通知后台goroutine退出
+	stop chan struct{}
+	//等待后台goroutine退出
+	wg sync.WaitGroup
+	//重试预算，没有配置WithRetry时为nil
+	budget *retryBudget
+	//请求的计数和直方图
+	metrics *metrics
+	//最后一个连接的编号
+	lastClientID uint64
 	//锁
 	lock sync.Mutex
 }
 
-func NewProxy(maxClient int, s server.Server) *ServerProxy {
-	return &ServerProxy{
+//NewProxy 新建一个Proxy，最多建立maxClient个到s的连接
+//配置了WithMaxIdleTime、WithMaxLifetime、WithMinIdle或者WithHealthCheck时会启动后台goroutine，不再使用时需要调用Close
+func NewProxy(maxClient int, s server.Server, opts ...Option) *ServerProxy {
+	return NewMultiProxy(maxClient, []Backend{{Server: s}}, opts...)
+}
+
+//NewMultiProxy 新建一个连接多个后端的Proxy，所有后端最多建立maxClient个连接，每个后端还可以通过Backend.MaxClient单独限制
+//每次请求通过WithBalancer配置的策略选择后端，默认是RoundRobin；backends不能为空
+func NewMultiProxy(maxClient int, backends []Backend, opts ...Option) *ServerProxy {
+	if len(backends) == 0 {
+		panic("proxy: NewMultiProxy without backend")
+	}
+	p := &ServerProxy{
 		dependencies: make(map[server.Client]*Response),
-		clients:      make(map[server.Client]struct{}),
+		clients:      make(map[server.Client]*clientInfo),
 		maxClient:    maxClient,
-		s:            s,
+		backends:     newBackends(backends),
+		opts:         newOptions(opts),
+		waiters:      list.New(),
+		stop:         make(chan struct{}),
+		refill:       make(chan struct{}, 1),
+		metrics:      newMetrics(),
+	}
+	p.minIdle = p.opts.minIdle
+	if p.minIdle > maxClient {
+		p.minIdle = maxClient
+	}
+	if p.opts.maxIdleConns > 0 && p.minIdle > p.opts.maxIdleConns {
+		p.minIdle = p.opts.maxIdleConns
 	}
+	if p.opts.retry != nil {
+		p.budget = newRetryBudget(p.opts.retry)
+	}
+	if interval := p.reapInterval(); interval > 0 {
+		p.wg.Add(1)
+		go p.reaper(interval)
+	}
+	if p.minIdle > 0 {
+		p.wg.Add(1)
+		go p.filler()
+		p.refillLocked()
+	}
+	if p.opts.healthCheck.Interval > 0 {
+		p.wg.Add(1)
+		go p.checker()
+	}
+	return p
 }
 
-//ClientCount 最大连接数
+//ClientCount 当前的连接数
 func (p *ServerProxy) ClientCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return len(p.clients)
 }
 
-//Request 请求
+//Request 请求，没有空闲连接并且连接数已满时立即返回ErrClientCountExceeded
 func (p *ServerProxy) Request(query []byte) (*Response, error) {
+	return p.request(context.Background(), query, false)
+}
+
+//RequestContext 请求，没有空闲连接并且连接数已满时排队等待其他请求释放连接，直到ctx被取消或超时
+//排队是先进先出的，等待的时间可以通过Response.WaitDuration获得
+func (p *ServerProxy) RequestContext(ctx context.Context, query []byte) (*Response, error) {
+	return p.request(ctx, query, true)
+}
+
+func (p *ServerProxy) request(ctx context.Context, query []byte, wait bool) (*Response, error) {
 	//request判断
-	if len(query) == 0 || !IsGoodRequest(query) {
-		return nil, ErrBadRequest
+	if err := p.opts.codec.ValidateRequest(query); err != nil {
+		p.metrics.finish(err, time.Time{})
+		return nil, err
 	}
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
-	//获取一个空闲连接，在没有超过最大连接数的情况下，如果当前没有空闲连接，会从server端新建
-	client, err := p.getFreeClientLocked()
+	start := time.Now()
+	state := &retryState{p: p, ctx: ctx, query: query, wait: wait, tracer: TracerFromContext(ctx)}
+	if p.budget != nil {
+		p.budget.deposit()
+	}
+	client, err := state.send(nil)
 	if err != nil {
+		p.metrics.finish(err, time.Time{})
 		return nil, err
 	}
 	//创建response并记录依赖
-	return p.createResponseLocked(query, client)
+	response := p.createResponse(client, query, start, state.tracer)
+	response.waitDuration = state.waited
+	p.stats.request()
+	//第一帧之前失败时Response还需要重新发送请求，调用方的query可能被复用，需要copy
+	if p.opts.retry != nil {
+		state.query = append([]byte(nil), query...)
+		response.retry = state
+	}
+	return response, nil
 }
 
-func (p *ServerProxy) getFreeClientLocked() (server.Client, error) {
+//acquire 占用一个空闲连接或者新建一个连接，同时返回排队等待连接的时间；配置了WithValidation时，校验失败的空闲连接被删除，换一个连接
+func (p *ServerProxy) acquire(ctx context.Context, query []byte, wait bool) (server.Client, time.Duration, error) {
+	var waited time.Duration
+	for {
+		//锁内只占用空闲连接或者新建连接的名额，新建连接、校验和发送请求都在锁外，慢的server不会阻塞其他请求和PutClient
+		p.lock.Lock()
+		//超过最大生命周期的空闲连接先删掉，不能等后台清理，否则它们一直占着连接数
+		expired := p.deleteExpiredClientsLocked(p.opts.clock.Now())
+		client, b, err := p.getFreeClientLocked(query)
+		if err == ErrClientCountExceeded && wait {
+			var d time.Duration
+			client, b, d, err = p.waitClientLocked(ctx)
+			waited += d
+		}
+		validate := err == nil && client != nil && p.needValidateLocked(client)
+		p.lock.Unlock()
+		for _, expiredClient := range expired {
+			p.discardClient(expiredClient, nil)
+		}
+		if err != nil {
+			return nil, waited, err
+		}
+		//拿到的是新建连接的名额
+		if client == nil {
+			span := TracerFromContext(ctx).StartSpan(SpanDial)
+			client, err = p.connect(b)
+			span.End(err)
+			if err == nil {
+				p.onCheckout(client)
+			}
+			return client, waited, err
+		}
+		if !validate || p.validate(client) == nil {
+			p.onCheckout(client)
+			return client, waited, nil
+		}
+		p.RemoveClient(client)
+	}
+}
 
-	//先看看缓存中是否有空闲的
-	if client := p.getCacheClientLocked(); client != nil {
-		return client, nil
+//waitClientLocked 排队等待其他请求释放连接，等待期间会释放锁，同时返回排队的时间；返回nil client时表示拿到了一个在backend上新建连接的名额
+func (p *ServerProxy) waitClientLocked(ctx context.Context) (client server.Client, b *backend, waited time.Duration, err error) {
+	req := make(chan connRequest, 1)
+	elem := p.waiters.PushBack(req)
+	p.lock.Unlock()
+	start := time.Now()
+	//在return设置了其他返回值之后记录
+	defer func() {
+		waited = time.Since(start)
+		p.stats.wait(waited)
+	}()
+	span := TracerFromContext(ctx).StartSpan(SpanPoolWait)
+
+	select {
+	case <-ctx.Done():
+		span.End(ctx.Err())
+		p.lock.Lock()
+		p.waiters.Remove(elem)
+		//取消的同时可能已经拿到了连接，要还回去
+		select {
+		case r := <-req:
+			p.releaseConnRequestLocked(r)
+		default:
+		}
+		return nil, nil, 0, ctx.Err()
+	case r := <-req:
+		span.End(r.err)
+		p.lock.Lock()
+		return r.client, r.backend, 0, r.err
 	}
-	//超出连接数
-	if len(p.clients) >= int(p.maxClient) {
-		return nil, ErrClientCountExceeded
+}
+
+//releaseConnRequestLocked 归还一个没有使用的connRequest
+func (p *ServerProxy) releaseConnRequestLocked(r connRequest) {
+	if r.err != nil {
+		return
 	}
-	//没有空闲连接，并且没有超出最大连接数，新建连接
-	client, err := p.s.Connect()
-	if err != nil {
-		return nil, err
+	if r.client != nil {
+		delete(p.dependencies, r.client)
+		p.putClientLocked(r.client)
+		return
 	}
-	p.clients[client] = struct{}{}
-	return client, nil
+	p.unreserveSlotLocked(r.backend)
+	p.cancelTrialLocked(r.backend)
+	p.releaseSlotLocked()
 }
 
-//getCacheClientLocked 从cache中获取
-func (p *ServerProxy) getCacheClientLocked() server.Client {
-	if len(p.clients) == 0 {
+//nextWaiterLocked 取出第一个排队的请求
+func (p *ServerProxy) nextWaiterLocked() chan connRequest {
+	elem := p.waiters.Front()
+	if elem == nil {
 		return nil
 	}
-	//在client中
-	for client, _ := range p.clients {
-		//但是没有依赖
-		if _, exists := p.dependencies[client]; !exists {
-			return client
+	return p.waiters.Remove(elem).(chan connRequest)
+}
+
+//getFreeClientLocked 按照负载均衡策略选择一个后端，占用它的一个空闲连接；
+//没有空闲连接并且没有超出最大连接数时，占用一个新建连接的名额并返回nil client和要连接的后端
+func (p *ServerProxy) getFreeClientLocked(query []byte) (server.Client, *backend, error) {
+	if p.isClosed {
+		return nil, nil, ErrProxyClosed
+	}
+	b, client := p.pickLocked(query)
+	if b == nil {
+		//所有后端都熔断了，不用等
+		if p.circuitOpenLocked() {
+			return nil, nil, ErrCircuitOpen
 		}
+		//所有后端都没有空闲连接，并且都超出了连接数
+		return nil, nil, ErrClientCountExceeded
 	}
-	return nil
+	p.takeTrialLocked(b)
+	if client != nil {
+		//先占用，避免被其他请求拿走
+		p.dependencies[client] = nil
+		return client, b, nil
+	}
+	//没有空闲连接，并且没有超出最大连接数，占用名额，在锁外新建连接
+	p.reserveSlotLocked(b)
+	return nil, b, nil
+}
+
+//reserveSlotLocked 占用b的一个新建连接的名额
+func (p *ServerProxy) reserveSlotLocked(b *backend) {
+	p.pending++
+	b.pending++
+}
+
+//unreserveSlotLocked 归还b的一个新建连接的名额
+func (p *ServerProxy) unreserveSlotLocked(b *backend) {
+	p.pending--
+	b.pending--
+}
+
+//canDialLocked b没有被摘除，熔断器放行，并且总连接数和b的连接数都没有超出限制
+func (p *ServerProxy) canDialLocked(b *backend) bool {
+	return !b.ejected && p.circuitAllowLocked(b) && len(p.clients)+p.pending < p.maxClient && (b.maxClient <= 0 || b.open+b.pending < b.maxClient)
 }
-func (p *ServerProxy) createResponseLocked(query []byte, client server.Client) (*Response, error) {
+
+//connect 使用已经占用的名额新建到b的连接，不需要持有锁
+func (p *ServerProxy) connect(b *backend) (server.Client, error) {
+	client, err := b.s.Connect()
+	p.stats.dial(err)
+	var hookErr error
+	if err == nil {
+		if hookErr = p.onConnect(client); hookErr != nil {
+			p.stats.close(closeHookError)
+		}
+	}
+
+	p.lock.Lock()
+	p.unreserveSlotLocked(b)
+	//OnConnect失败是调用方的问题，不计入后端的失败，归还半开状态下的试探名额
+	if hookErr != nil {
+		p.cancelTrialLocked(b)
+		p.releaseSlotLocked()
+		p.lock.Unlock()
+		p.log(LevelWarn, "connect hook failed", LogKeyBackend, b.name, LogKeyError, hookErr)
+		return nil, hookErr
+	}
+	//建立连接期间Proxy被关闭了
+	if err == nil && p.isClosed {
+		p.lock.Unlock()
+		p.discardClient(client, nil)
+		return nil, ErrProxyClosed
+	}
+	if err != nil {
+		event := p.recordFailureLocked(b, err)
+		//名额让给下一个排队的请求
+		p.releaseSlotLocked()
+		p.lock.Unlock()
+		p.emitOutlierEvent(event)
+		p.log(LevelWarn, "dial failed", LogKeyBackend, b.name, LogKeyError, err)
+		return nil, err
+	}
+	defer p.lock.Unlock()
+	now := p.opts.clock.Now()
+	p.lastClientID++
+	p.clients[client] = &clientInfo{createdAt: now, returnedAt: now, backend: b, id: p.lastClientID}
+	b.open++
+	p.dependencies[client] = nil
+	return client, nil
+}
+
+//sendRequest 在已经占用的连接上发送请求，不需要持有锁
+func (p *ServerProxy) sendRequest(query []byte, client server.Client) error {
 	err := client.Request(query)
 	//如果请求失败了，连接可能有问题丢弃连接
 	if err != nil {
-		p.deleteClientLocked(client)
-		//此处如果支持多次尝试，返回一个固定类型的错误，让上层判断是否需要重试，这里返回ErrBadConnection,上层基于这个做判断，目前不做重试
-		//TODO 基于错误类型做判断
-		return nil, fmt.Errorf("%s[%w]", err.Error(), ErrBadConnection)
+		//返回一个固定类型的错误，按照重试策略判断是否需要重试
+		err = fmt.Errorf("%s[%w]", err.Error(), ErrBadConnection)
+		p.removeClient(client, err)
+		return err
+	}
+	return nil
+}
+
+//createResponse 在已经发送了请求的连接上创建response，start是请求开始的时间
+func (p *ServerProxy) createResponse(client server.Client, query []byte, start time.Time, tracer Tracer) *Response {
+	response := newResponse(client, p, p.opts)
+	response.stats = &p.stats
+	response.metrics = p.metrics
+	response.start = start
+	response.tracer = tracer
+	if p.opts.logger != nil {
+		response.fingerprint = fingerprint(query)
 	}
+	p.trackResponse(client, response)
+	return response
+}
 
-	response := NewResponse(client, p)
-	//占用一个连接
+//trackResponse 记录连接被response占用
+func (p *ServerProxy) trackResponse(client server.Client, response *Response) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.dependencies[client] = response
-	return response, nil
 }
 
-//deleteClientLocked 删除连接
-func (p *ServerProxy) deleteClientLocked(client server.Client) {
-	if _, exists := p.clients[client]; exists {
-		delete(p.clients, client)
-	}
+//deleteClientLocked 因为reason删除连接，返回连接是否存在，存在时调用方需要在锁外关闭它
+func (p *ServerProxy) deleteClientLocked(client server.Client, reason closeReason) bool {
 	if _, exists := p.dependencies[client]; exists {
 		delete(p.dependencies, client)
 	}
+	info, exists := p.clients[client]
+	if !exists {
+		return false
+	}
+	info.backend.open--
+	delete(p.clients, client)
+	p.stats.close(reason)
+	//空出了一个名额
+	p.releaseSlotLocked()
+	p.refillLocked()
+	return true
+}
+
+//putClientLocked 连接空闲了，有排队的请求时直接交给第一个排队的请求
+func (p *ServerProxy) putClientLocked(client server.Client) {
+	if req := p.nextWaiterLocked(); req != nil {
+		//先占用，避免被其他请求当作空闲连接拿走
+		p.dependencies[client] = nil
+		req <- connRequest{client: client}
+	}
+}
+
+//releaseSlotLocked 空出了一个名额，有排队的请求并且有后端可以新建连接时，交给第一个排队的请求去新建连接
+func (p *ServerProxy) releaseSlotLocked() {
+	if p.waiters.Len() == 0 {
+		return
+	}
+	b := p.pickDialLocked()
+	if b == nil {
+		return
+	}
+	p.reserveSlotLocked(b)
+	p.takeTrialLocked(b)
+	p.nextWaiterLocked() <- connRequest{backend: b}
 }
 
-//PutClient 回收连接
+//PutClient 回收连接；Proxy已经关闭、连接超过最大生命周期或者空闲连接超过上限时直接关闭连接
 func (p *ServerProxy) PutClient(client server.Client) {
+	p.putClient(client, true)
+}
+
+//putClient 回收连接；used为false时（比如健康检查）连接没有被请求使用过，不更新空闲开始的时间，也不调用OnCheckin
+func (p *ServerProxy) putClient(client server.Client, used bool) {
+	var checkinErr error
+	if used {
+		checkinErr = p.onCheckin(client)
+	}
 	p.lock.Lock()
-	defer p.lock.Unlock()
+	//已经被删除的连接不能再用了
+	info, exists := p.clients[client]
+	if !exists {
+		p.lock.Unlock()
+		return
+	}
+	var slow *logEntry
+	if response := p.dependencies[client]; response != nil && p.slowLocked(response) {
+		slow = p.connLogEntryLocked(LevelWarn, "slow response", client, nil)
+	}
+	defer p.emitLog(slow)
 	//删除依赖就好
 	if _, exists := p.dependencies[client]; exists {
 		delete(p.dependencies, client)
 	}
+	now := p.opts.clock.Now()
+	if used {
+		info.returnedAt = now
+		p.recordSuccessLocked(info.backend)
+	}
+	//OnCheckin失败是调用方的问题，后端已经正常返回了，不计入后端的失败
+	if checkinErr != nil {
+		var entry *logEntry
+		if p.opts.logger != nil {
+			entry = p.removeLogEntryLocked(client, closeHookError, checkinErr)
+		}
+		p.deleteClientLocked(client, closeHookError)
+		p.lock.Unlock()
+		p.discardClient(client, checkinErr)
+		p.emitLog(entry)
+		return
+	}
+	if reason, retire := p.retireLocked(info, now); retire {
+		p.deleteClientLocked(client, reason)
+		p.lock.Unlock()
+		p.discardClient(client, nil)
+		return
+	}
+	p.putClientLocked(client)
+	p.lock.Unlock()
 }
 
-//RemoveClient 删除连接
+//RemoveClient 删除并关闭连接，连接有问题时调用；不知道原因，不计入后端的连续失败次数
 func (p *ServerProxy) RemoveClient(client server.Client) {
+	p.removeClient(client, nil)
+}
+
+//removeClient 因为err删除并关闭连接，err用来统计关闭的原因，为nil时表示原因未知
+func (p *ServerProxy) removeClient(client server.Client, err error) {
+	reason := closeReasonOf(err)
+	if err == nil {
+		err = ErrBadConnection
+	}
 	p.lock.Lock()
-	defer p.lock.Unlock()
-	if _, exists := p.dependencies[client]; exists {
-		delete(p.dependencies, client)
+	info, exists := p.clients[client]
+	var event *OutlierEvent
+	var entry *logEntry
+	if exists {
+		if p.opts.logger != nil {
+			entry = p.removeLogEntryLocked(client, reason, err)
+		}
+		//只有读写失败和报文格式错误是后端的问题；调用方清空超限、没有原因的RemoveClient等不算
+		//先记录失败，熔断时空出的名额不会再交给排队的请求
+		if reason == closeProtocolError || reason == closeReadError {
+			event = p.recordFailureLocked(info.backend, err)
+		} else {
+			//不是后端的问题，半开状态下归还试探名额，让其他请求去试探
+			p.cancelTrialLocked(info.backend)
+		}
+		p.deleteClientLocked(client, reason)
 	}
-	if _, exists := p.clients[client]; exists {
-		delete(p.clients, client)
+	p.lock.Unlock()
+	if exists {
+		p.discardClient(client, err)
 	}
+	p.emitOutlierEvent(event)
+	p.emitLog(entry)
 }
 
 //GetMaxCount 获取最大连接数
@@ -159,3 +551,193 @@ func (p *ServerProxy) GetMaxCount() int {
 	//TODO 更改maxClient为int32, 然后使用atomic获取，当前没有设置逻辑，所以还好
 	return p.maxClient
 }
+
+//Close 关闭Proxy：停止后台清理，关闭所有空闲连接，排队的请求返回ErrProxyClosed，之后的请求也返回ErrProxyClosed
+//正在使用的连接在Response结束回收时关闭
+func (p *ServerProxy) Close() error {
+	p.lock.Lock()
+	if p.isClosed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.isClosed = true
+	close(p.stop)
+	for req := p.nextWaiterLocked(); req != nil; req = p.nextWaiterLocked() {
+		req <- connRequest{err: ErrProxyClosed}
+	}
+	idle := p.deleteIdleClientsLocked(closeOther, func(*clientInfo) bool { return true })
+	p.lock.Unlock()
+
+	p.wg.Wait()
+	for _, client := range idle {
+		p.discardClient(client, nil)
+	}
+	return nil
+}
+
+//expiredLocked 连接是否超过了最大生命周期
+func (p *ServerProxy) expiredLocked(info *clientInfo, now time.Time) bool {
+	return p.opts.maxLifetime > 0 && now.Sub(info.createdAt) >= p.opts.maxLifetime
+}
+
+//deleteExpiredClientsLocked 删除超过最大生命周期的空闲连接，返回被删除的连接，调用方需要在锁外关闭它们
+func (p *ServerProxy) deleteExpiredClientsLocked(now time.Time) []server.Client {
+	if p.opts.maxLifetime <= 0 {
+		return nil
+	}
+	return p.deleteIdleClientsLocked(closeMaxLifetime, func(info *clientInfo) bool {
+		return p.expiredLocked(info, now)
+	})
+}
+
+//retireLocked 回收的连接是否应该关闭而不是复用，以及关闭的原因；有排队的请求时不受空闲连接数的限制
+func (p *ServerProxy) retireLocked(info *clientInfo, now time.Time) (closeReason, bool) {
+	if p.isClosed {
+		return closeOther, true
+	}
+	if p.expiredLocked(info, now) {
+		return closeMaxLifetime, true
+	}
+	//调用前已经删除了依赖，空闲连接数包括它自己
+	return closeMaxIdle, p.opts.maxIdleConns > 0 && p.waiters.Len() == 0 && p.idleCountLocked() > p.opts.maxIdleConns
+}
+
+//idleCountLocked 空闲连接数，被占用的连接都在dependencies中
+func (p *ServerProxy) idleCountLocked() int {
+	return len(p.clients) - len(p.dependencies)
+}
+
+//deleteIdleClientsLocked 因为reason删除满足条件的空闲连接，返回被删除的连接，调用方需要在锁外关闭它们
+func (p *ServerProxy) deleteIdleClientsLocked(reason closeReason, match func(*clientInfo) bool) []server.Client {
+	var deleted []server.Client
+	for client, info := range p.clients {
+		if _, busy := p.dependencies[client]; busy || !match(info) {
+			continue
+		}
+		p.deleteClientLocked(client, reason)
+		deleted = append(deleted, client)
+	}
+	return deleted
+}
+
+//reapInterval 后台清理的间隔，取空闲超时和最大生命周期中较小的一个；都没有配置时返回0，不需要后台清理
+func (p *ServerProxy) reapInterval() time.Duration {
+	interval := p.opts.maxIdleTime
+	if interval <= 0 || (p.opts.maxLifetime > 0 && p.opts.maxLifetime < interval) {
+		interval = p.opts.maxLifetime
+	}
+	if interval <= 0 {
+		return 0
+	}
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	return interval
+}
+
+//reaper 后台定时清理空闲超时和超过最大生命周期的空闲连接，直到Close
+func (p *ServerProxy) reaper(interval time.Duration) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.opts.clock.After(interval):
+		}
+		p.reap()
+	}
+}
+
+//reap 清理一次，网络IO（关闭连接）在锁外；空闲超时不会让空闲连接少于minIdle，超过最大生命周期的连接删除后再补齐
+func (p *ServerProxy) reap() {
+	now := p.opts.clock.Now()
+	p.lock.Lock()
+	expired := p.deleteExpiredClientsLocked(now)
+	idle := p.idleCountLocked()
+	expired = append(expired, p.deleteIdleClientsLocked(closeIdleTimeout, func(info *clientInfo) bool {
+		if p.opts.maxIdleTime > 0 && now.Sub(info.returnedAt) >= p.opts.maxIdleTime && idle > p.minIdle {
+			idle--
+			return true
+		}
+		return false
+	})...)
+	p.lock.Unlock()
+	for _, client := range expired {
+		p.discardClient(client, nil)
+	}
+}
+
+//closeClient 关闭被丢弃的连接，Client没有实现server.CloseClient时什么都不做
+func closeClient(client server.Client) {
+	if closer, ok := client.(server.CloseClient); ok {
+		closer.Close()
+	}
+}
+
+//refillLocked 空闲连接可能少于minIdle了，通知后台补齐，不会阻塞
+func (p *ServerProxy) refillLocked() {
+	if p.minIdle <= 0 || p.isClosed {
+		return
+	}
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+//filler 后台补齐空闲连接到minIdle，直到Close；连续建立失败时退避重试
+func (p *ServerProxy) filler() {
+	defer p.wg.Done()
+	backoff := minRefillBackoff
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.refill:
+		}
+		for b := p.reserveIdleSlot(); b != nil; b = p.reserveIdleSlot() {
+			if err := p.connectIdle(b); err == nil {
+				backoff = minRefillBackoff
+				continue
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-p.opts.clock.After(backoff):
+			}
+			if backoff *= 2; backoff > maxRefillBackoff {
+				backoff = maxRefillBackoff
+			}
+		}
+	}
+}
+
+//reserveIdleSlot 空闲连接少于minIdle并且没有超出最大连接数时，按照负载均衡策略选择后端并占用一个新建连接的名额
+func (p *ServerProxy) reserveIdleSlot() *backend {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isClosed || p.idleCountLocked() >= p.minIdle {
+		return nil
+	}
+	b := p.pickDialLocked()
+	if b != nil {
+		p.reserveSlotLocked(b)
+		p.takeTrialLocked(b)
+	}
+	return b
+}
+
+//connectIdle 使用已经占用的名额新建一个到b的空闲连接，有排队的请求时直接交给它
+//连接没有被请求使用过，不调用OnCheckin，也不算作一次成功的请求
+func (p *ServerProxy) connectIdle(b *backend) error {
+	client, err := p.connect(b)
+	if err != nil {
+		return err
+	}
+	//建立连接不算试探，归还半开状态下占用的试探名额
+	p.lock.Lock()
+	p.cancelTrialLocked(b)
+	p.lock.Unlock()
+	p.putClient(client, false)
+	return nil
+}
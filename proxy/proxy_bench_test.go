@@ -0,0 +1,79 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//slowServer 连接和发送请求都很慢的server，用来观察慢IO对其他请求的影响
+type slowServer struct {
+	dialDelay    time.Duration
+	requestDelay time.Duration
+}
+
+func (s *slowServer) Connect() (server.Client, error) {
+	time.Sleep(s.dialDelay)
+	return &slowClient{requestDelay: s.requestDelay}, nil
+}
+
+//slowClient 每个请求返回一个protocol和结束
+type slowClient struct {
+	requestDelay time.Duration
+	lock         sync.Mutex
+	pending      bool
+}
+
+func (c *slowClient) Request([]byte) error {
+	time.Sleep(c.requestDelay)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = true
+	return nil
+}
+
+func (c *slowClient) Read(data []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.pending {
+		return 0, io.EOF
+	}
+	c.pending = false
+	return copy(data, "DaaaaaaaaaZ"), nil
+}
+
+func benchmarkSlowServer(b *testing.B, s *slowServer) {
+	p := proxy.NewProxy(64, s)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			response, err := p.RequestContext(context.Background(), []byte("Qxxxxx"))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			for _, err = response.Read(); err == nil; _, err = response.Read() {
+			}
+			if err != io.EOF {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+//BenchmarkSlowRequest 每次发送请求需要100µs
+func BenchmarkSlowRequest(b *testing.B) {
+	benchmarkSlowServer(b, &slowServer{requestDelay: 100 * time.Microsecond})
+}
+
+//BenchmarkSlowConnect 每次新建连接需要10ms，发送请求需要10µs
+func BenchmarkSlowConnect(b *testing.B) {
+	benchmarkSlowServer(b, &slowServer{dialDelay: 10 * time.Millisecond, requestDelay: 10 * time.Microsecond})
+}
@@ -1,12 +1,15 @@
 package proxy_test
 
 import (
+	"context"
+	"errors"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/onsi/gomega"
 	"github.com/weenxin/simple-tcp-proxy/proxy"
 	"github.com/weenxin/simple-tcp-proxy/server"
 	"io"
 	"sync"
+	"time"
 )
 
 var _ = ginkgo.Describe("Proxy", func() {
@@ -57,12 +60,17 @@ var _ = ginkgo.Describe("Proxy", func() {
 				p = proxy.NewProxy(5, s)
 			})
 
-			ginkgo.It("close connection and return server protocol not matched", func() {
+			ginkgo.It("close connection and return truncated response error", func() {
 				response, err := p.Request([]byte("Qaafdas"))
 				gomega.Expect(err).To(gomega.BeNil())
 				protocol, err := response.Read()
-				ginkgo.By("return server protocol not matched error")
-				gomega.Expect(err).To(gomega.Equal(io.EOF))
+				ginkgo.By("return truncated response error instead of io.EOF")
+				gomega.Expect(errors.Is(err, proxy.ErrTruncatedResponse)).To(gomega.BeTrue())
+				gomega.Expect(errors.Is(err, io.EOF)).To(gomega.BeFalse())
+				var truncated *proxy.TruncatedResponseError
+				gomega.Expect(errors.As(err, &truncated)).To(gomega.BeTrue())
+				gomega.Expect(truncated.Frames).To(gomega.Equal(0))
+				gomega.Expect(truncated.Bytes).To(gomega.Equal(len("Dsjflfajsdj")))
 				ginkgo.By("protocol is nil")
 				gomega.Expect(len(protocol)).To(gomega.Equal(0))
 				ginkgo.By("client is empty")
@@ -266,4 +274,157 @@ var _ = ginkgo.Describe("Proxy", func() {
 
 	})
 
+	ginkgo.Describe("RequestContext", func() {
+		var backend *mockProxyServer
+
+		ginkgo.When("all connections are busy and one is put back", func() {
+			ginkgo.BeforeEach(func() {
+				backend = &mockProxyServer{
+					response: [][]byte{
+						[]byte("Daaaaaaaaa"), []byte("Z"),
+						[]byte("Dcccccccc"), []byte("Z"),
+					},
+				}
+				p = proxy.NewProxy(1, backend)
+			})
+
+			ginkgo.It("wait and reuse the released client", func() {
+				first, err := p.Request([]byte("Qfirst"))
+				gomega.Expect(err).To(gomega.BeNil())
+
+				result := make(chan *proxy.Response, 1)
+				go func() {
+					defer ginkgo.GinkgoRecover()
+					response, err := p.RequestContext(context.Background(), []byte("Qsecond"))
+					gomega.Expect(err).To(gomega.BeNil())
+					result <- response
+				}()
+				gomega.Consistently(result, 50*time.Millisecond).ShouldNot(gomega.Receive())
+
+				ginkgo.By("release the client by reading all the data")
+				_, err = first.Read()
+				gomega.Expect(err).To(gomega.BeNil())
+				_, err = first.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+
+				var second *proxy.Response
+				gomega.Eventually(result).Should(gomega.Receive(&second))
+				gomega.Expect(second.WaitDuration()).To(gomega.BeNumerically(">=", 50*time.Millisecond))
+				protocol, err := second.Read()
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(string(protocol)).To(gomega.Equal("Dcccccccc"))
+				gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+				gomega.Expect(len(backend.clients)).To(gomega.Equal(1))
+			})
+		})
+
+		ginkgo.When("nothing is queued but the dial is slow", func() {
+			ginkgo.BeforeEach(func() {
+				backend = &mockProxyServer{
+					response:  [][]byte{[]byte("Daaaaaaaaa"), []byte("Z")},
+					onConnect: func() { time.Sleep(50 * time.Millisecond) },
+				}
+				p = proxy.NewProxy(1, backend)
+			})
+
+			ginkgo.It("not count the dial as waiting", func() {
+				response, err := p.RequestContext(context.Background(), []byte("Qfirst"))
+				gomega.Expect(err).To(gomega.BeNil())
+				gomega.Expect(response.WaitDuration()).To(gomega.BeZero())
+				gomega.Expect(p.Stats().WaitCount).To(gomega.BeZero())
+				readAll(response)
+			})
+		})
+
+		ginkgo.When("more than one request is waiting", func() {
+			ginkgo.BeforeEach(func() {
+				backend = &mockProxyServer{
+					response: [][]byte{
+						[]byte("Daaaaaaaaa"), []byte("Z"),
+						[]byte("Dbbbbbbbbb"), []byte("Z"),
+						[]byte("Dcccccccc"), []byte("Z"),
+					},
+				}
+				p = proxy.NewProxy(1, backend)
+			})
+
+			ginkgo.It("hand over the client first in first out", func() {
+				first, err := p.Request([]byte("Qfirst"))
+				gomega.Expect(err).To(gomega.BeNil())
+
+				order := make(chan string, 2)
+				for _, query := range []string{"Qsecond", "Qthird"} {
+					go func(query string) {
+						defer ginkgo.GinkgoRecover()
+						response, err := p.RequestContext(context.Background(), []byte(query))
+						gomega.Expect(err).To(gomega.BeNil())
+						order <- query
+						for _, err = response.Read(); err == nil; _, err = response.Read() {
+						}
+					}(query)
+					//保证入队的顺序
+					time.Sleep(20 * time.Millisecond)
+				}
+
+				for _, err = first.Read(); err == nil; _, err = first.Read() {
+				}
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+				gomega.Eventually(order).Should(gomega.Receive(gomega.Equal("Qsecond")))
+				gomega.Eventually(order).Should(gomega.Receive(gomega.Equal("Qthird")))
+			})
+		})
+
+		ginkgo.When("context is done before a client is released", func() {
+			ginkgo.BeforeEach(func() {
+				backend = &mockProxyServer{
+					response: [][]byte{[]byte("Daaaaaaaaa"), []byte("Z")},
+				}
+				p = proxy.NewProxy(1, backend)
+			})
+
+			ginkgo.It("return the context error", func() {
+				_, err := p.Request([]byte("Qfirst"))
+				gomega.Expect(err).To(gomega.BeNil())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+				response, err := p.RequestContext(ctx, []byte("Qsecond"))
+				gomega.Expect(err).To(gomega.Equal(context.DeadlineExceeded))
+				gomega.Expect(response).To(gomega.BeNil())
+				gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+			})
+		})
+
+		ginkgo.When("a busy client is removed", func() {
+			ginkgo.BeforeEach(func() {
+				backend = &mockProxyServer{
+					response: [][]byte{[]byte("lsjflfajsdj")},
+				}
+				p = proxy.NewProxy(1, backend)
+			})
+
+			ginkgo.It("waiting request create a new client", func() {
+				first, err := p.Request([]byte("Qfirst"))
+				gomega.Expect(err).To(gomega.BeNil())
+
+				result := make(chan *proxy.Response, 1)
+				go func() {
+					defer ginkgo.GinkgoRecover()
+					response, err := p.RequestContext(context.Background(), []byte("Qsecond"))
+					gomega.Expect(err).To(gomega.BeNil())
+					result <- response
+				}()
+				time.Sleep(20 * time.Millisecond)
+
+				ginkgo.By("bad protocol remove the client")
+				_, err = first.Read()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+
+				gomega.Eventually(result).Should(gomega.Receive())
+				gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+				gomega.Expect(len(backend.clients)).To(gomega.Equal(2))
+			})
+		})
+	})
+
 })
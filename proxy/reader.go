@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+//ReaderMode Response.Reader读出的内容
+type ReaderMode int
+
+const (
+	//RawFrames 原样的帧，包括帧头、错误帧和最后的结束帧，可以直接转发给用户
+	RawFrames ReaderMode = iota
+	//Payloads 只有`D`帧的内容，去掉帧头，不包括结束帧；遇到错误帧返回*ServerError
+	Payloads
+)
+
+//PayloadCodec 可选接口，Codec实现了它时Payloads模式用它去掉帧头，否则去掉第一个字节（类型）
+type PayloadCodec interface {
+	Codec
+	//Payload 返回帧的内容，是frame中的片段
+	Payload(frame []byte) []byte
+}
+
+//Payload 去掉类型和长度
+func (LengthPrefixedCodec) Payload(frame []byte) []byte {
+	return frame[LengthPrefixedHeaderSize:]
+}
+
+//ResponseReader 把Response适配成io.Reader和io.WriterTo，读到结束后连接自动回收；中途放弃时调用Close清空未读报文并回收连接
+type ResponseReader struct {
+	response *Response
+	mode     ReaderMode
+	//当前帧还没有被读走的部分，指向Response的缓存，下一次Response.Read之前必须读完
+	pending []byte
+	//出错或者读完之后一直返回这个错误
+	err error
+}
+
+//Reader 获得Response的io.Reader适配，和Read()不能混用
+func (r *Response) Reader(mode ReaderMode) *ResponseReader {
+	return &ResponseReader{response: r, mode: mode}
+}
+
+//Read 实现io.Reader，数据从Response的缓存中copy到p
+func (rr *ResponseReader) Read(p []byte) (int, error) {
+	for len(rr.pending) == 0 {
+		if err := rr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, rr.pending)
+	rr.pending = rr.pending[n:]
+	return n, nil
+}
+
+//WriteTo 实现io.WriterTo，直接把Response的缓存写入w，没有额外的copy；写失败时关闭Response，清空未读报文并回收连接
+func (rr *ResponseReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if len(rr.pending) > 0 {
+			n, err := w.Write(rr.pending)
+			written += int64(n)
+			rr.pending = rr.pending[n:]
+			if err != nil {
+				rr.fail(err)
+				rr.response.Close()
+				return written, err
+			}
+		}
+		if err := rr.next(); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
+
+//Close 实现io.Closer，关闭Response
+func (rr *ResponseReader) Close() error {
+	rr.pending = nil
+	rr.fail(io.EOF)
+	return rr.response.Close()
+}
+
+//next 从Response中读取下一帧放到pending中
+func (rr *ResponseReader) next() error {
+	if rr.err != nil {
+		return rr.err
+	}
+	frame, err := rr.response.Read()
+	if err == io.EOF {
+		rr.fail(io.EOF)
+		//原样转发时，结束帧也要写出去
+		if rr.mode == RawFrames {
+			rr.pending = rr.response.Trailer()
+			return nil
+		}
+		return io.EOF
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		if rr.mode == RawFrames {
+			rr.pending = serverErr.Frame
+			return nil
+		}
+		//Payloads模式下错误帧结束读取，清空剩下的报文并回收连接
+		rr.fail(err)
+		rr.response.Close()
+		return err
+	}
+	//Response已经丢弃了连接
+	if err != nil {
+		rr.fail(err)
+		return err
+	}
+	rr.pending = frame
+	//分块交付的后续块没有帧头
+	if rr.mode == Payloads && !rr.response.continued {
+		rr.pending = rr.payload(frame)
+	}
+	return nil
+}
+
+func (rr *ResponseReader) payload(frame []byte) []byte {
+	if codec, ok := rr.response.opts.codec.(PayloadCodec); ok {
+		return codec.Payload(frame)
+	}
+	return frame[1:]
+}
+
+func (rr *ResponseReader) fail(err error) {
+	if rr.err == nil {
+		rr.err = err
+	}
+}
@@ -0,0 +1,136 @@
+package proxy_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing/iotest"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//failWriter 写入limit个字节后失败
+type failWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errWriteFailed
+	}
+	return w.buf.Write(p)
+}
+
+var _ = ginkgo.Describe("ResponseReader", func() {
+	var tmpProxy *mockProxy
+	var client *mockStringsClient
+
+	ginkgo.BeforeEach(func() {
+		tmpProxy = &mockProxy{
+			clients: make(map[server.Client]bool),
+		}
+		client = &mockStringsClient{
+			protocols: [][]byte{[]byte("DaaaaDbb"), []byte("bbDcccc"), []byte("Z")},
+		}
+	})
+
+	ginkgo.When("read raw frames", func() {
+		ginkgo.It("return all bytes including the end and recycle the client", func() {
+			data, err := io.ReadAll(proxy.NewResponse(client, tmpProxy).Reader(proxy.RawFrames))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("DaaaaDbbbbDccccZ"))
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+		})
+
+		ginkgo.It("work with a small read buffer", func() {
+			data, err := io.ReadAll(iotest.OneByteReader(proxy.NewResponse(client, tmpProxy).Reader(proxy.RawFrames)))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("DaaaaDbbbbDccccZ"))
+		})
+	})
+
+	ginkgo.When("read payloads", func() {
+		ginkgo.It("return payloads without type byte", func() {
+			data, err := io.ReadAll(proxy.NewResponse(client, tmpProxy).Reader(proxy.Payloads))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("aaaabbbbcccc"))
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+		})
+
+		ginkgo.It("return payloads without length header", func() {
+			stream := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("D and Z,"))
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'D', []byte("any bytes"))
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'Z', nil)
+			client := &chunkClient{data: stream, size: 4}
+			response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}))
+			data, err := io.ReadAll(response.Reader(proxy.Payloads))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("D and Z,any bytes"))
+		})
+
+		ginkgo.It("strip the header only from the first chunk of a large frame", func() {
+			payload := bytes.Repeat([]byte("0123456789"), 10)
+			stream := proxy.AppendLengthPrefixedFrame(nil, 'D', payload)
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'Z', nil)
+			client := &chunkClient{data: stream, size: 16}
+			response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}),
+				proxy.WithMaxFrameSize(16), proxy.WithLargeFrameStreaming())
+			data, err := io.ReadAll(response.Reader(proxy.Payloads))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(data).To(gomega.Equal(payload))
+		})
+
+		ginkgo.It("return server error on error frame and recycle the client", func() {
+			stream := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("row"))
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'E', []byte("oops"))
+			stream = proxy.AppendLengthPrefixedFrame(stream, 'Z', nil)
+			client := &chunkClient{data: stream, size: 64}
+			response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}))
+			data, err := io.ReadAll(response.Reader(proxy.Payloads))
+			gomega.Expect(string(data)).To(gomega.Equal("row"))
+			gomega.Expect(errors.Is(err, proxy.ErrServerError)).To(gomega.BeTrue())
+			gomega.Expect(response.IsClosed()).To(gomega.BeTrue())
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+		})
+	})
+
+	ginkgo.When("copy to a writer", func() {
+		ginkgo.It("write all frames through WriterTo", func() {
+			var buf bytes.Buffer
+			n, err := io.Copy(&buf, proxy.NewResponse(client, tmpProxy).Reader(proxy.RawFrames))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(n).To(gomega.Equal(int64(len("DaaaaDbbbbDccccZ"))))
+			gomega.Expect(buf.String()).To(gomega.Equal("DaaaaDbbbbDccccZ"))
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+		})
+
+		ginkgo.It("close the response and recycle the client when write failed", func() {
+			w := &failWriter{limit: 5}
+			response := proxy.NewResponse(client, tmpProxy)
+			_, err := response.Reader(proxy.RawFrames).WriteTo(w)
+			gomega.Expect(err).To(gomega.Equal(errWriteFailed))
+			gomega.Expect(w.buf.String()).To(gomega.Equal("Daaaa"))
+			gomega.Expect(response.IsClosed()).To(gomega.BeTrue())
+			gomega.Expect(client.index).To(gomega.Equal(len(client.protocols)))
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+		})
+	})
+
+	ginkgo.When("close the reader in the middle", func() {
+		ginkgo.It("drain the response and recycle the client", func() {
+			reader := proxy.NewResponse(client, tmpProxy).Reader(proxy.RawFrames)
+			_, err := reader.Read(make([]byte, 2))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(reader.Close()).To(gomega.Succeed())
+			gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			_, err = reader.Read(make([]byte, 2))
+			gomega.Expect(err).To(gomega.Equal(io.EOF))
+		})
+	})
+})
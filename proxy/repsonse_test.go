@@ -1,11 +1,14 @@
 package proxy_test
 
 import (
+	"bytes"
+	"errors"
 	"github.com/onsi/ginkgo/v2"
 	"github.com/onsi/gomega"
 	"github.com/weenxin/simple-tcp-proxy/proxy"
 	"github.com/weenxin/simple-tcp-proxy/server"
 	"io"
+	"time"
 )
 
 const (
@@ -167,4 +170,309 @@ var _ = ginkgo.Describe("Repsonse", func() {
 		})
 
 	})
+	ginkgo.Describe("close with bounded drain", func() {
+		var response *proxy.Response
+		var client *mockDeadlineClient
+		var tmpProxy *mockProxy
+
+		ginkgo.BeforeEach(func() {
+			tmpProxy = &mockProxy{
+				clients: make(map[server.Client]bool),
+			}
+		})
+
+		ginkgo.When("server does not send the end in drain timeout", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockDeadlineClient{mockStringsClient: mockStringsClient{
+					protocols: [][]byte{[]byte("Daaaaaaaaa")},
+				}}
+				response = proxy.NewResponse(client, tmpProxy, proxy.WithDrainTimeout(30*time.Millisecond))
+			})
+
+			ginkgo.It("return drain timeout error and discard the client", func() {
+				start := time.Now()
+				err := response.Close()
+				gomega.Expect(errors.Is(err, proxy.ErrDrainTimeout)).To(gomega.BeTrue())
+				gomega.Expect(time.Since(start)).To(gomega.BeNumerically(">=", 30*time.Millisecond))
+				gomega.Expect(response.IsClosed()).To(gomega.Equal(true))
+				ginkgo.By("client is not recycled")
+				gomega.Expect(len(tmpProxy.clients)).To(gomega.Equal(0))
+			})
+		})
+
+		ginkgo.When("server send the end in drain timeout", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockDeadlineClient{mockStringsClient: mockStringsClient{
+					protocols: [][]byte{[]byte("Daaaaaaaaa"), []byte("Z")},
+				}}
+				response = proxy.NewResponse(client, tmpProxy, proxy.WithDrainTimeout(time.Second))
+			})
+
+			ginkgo.It("recycle the client and reset the read deadline", func() {
+				gomega.Expect(response.Close()).To(gomega.Succeed())
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+				gomega.Expect(client.deadline.IsZero()).To(gomega.BeTrue())
+			})
+		})
+
+		ginkgo.When("server send more data than drain limit", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockDeadlineClient{mockStringsClient: mockStringsClient{
+					protocols: [][]byte{
+						[]byte("Daaaaaaaaa"), []byte("Dbbbbbbbbb"), []byte("Dcccccccccc"), []byte("Z"),
+					},
+				}}
+				response = proxy.NewResponse(client, tmpProxy, proxy.WithDrainLimit(20))
+			})
+
+			ginkgo.It("return drain limit exceeded error and discard the client", func() {
+				err := response.Close()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrDrainLimitExceeded))
+				ginkgo.By("stop reading before the end once the limit is reached")
+				gomega.Expect(client.index).To(gomega.BeNumerically("<", len(client.protocols)))
+				ginkgo.By("client is not recycled")
+				gomega.Expect(len(tmpProxy.clients)).To(gomega.Equal(0))
+			})
+		})
+	})
+	ginkgo.Describe("close drain frame by frame", func() {
+		var response *proxy.Response
+		var client *mockStringsClient
+		var tmpProxy *mockProxy
+
+		ginkgo.BeforeEach(func() {
+			tmpProxy = &mockProxy{
+				clients: make(map[server.Client]bool),
+			}
+		})
+
+		ginkgo.When("the end is already buffered by a previous read", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockStringsClient{
+					protocols: [][]byte{[]byte("DaaaaaaaaaDbbbbbbbbbZ")},
+				}
+				response = proxy.NewResponse(client, tmpProxy)
+				data, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(data)).To(gomega.Equal("Daaaaaaaaa"))
+			})
+
+			ginkgo.It("recycle the client without reading the connection again", func() {
+				client.status = clientStatusShouldNeverRead
+				gomega.Expect(response.Close()).To(gomega.Succeed())
+				gomega.Expect(response.IsClosed()).To(gomega.Equal(true))
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			})
+		})
+
+		ginkgo.When("protocols are fragmented across reads", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockStringsClient{
+					protocols: [][]byte{
+						[]byte("Daa"), []byte("aaDb"), []byte("bbb"), []byte("Dcc"), []byte("Z"),
+					},
+				}
+				response = proxy.NewResponse(client, tmpProxy)
+			})
+
+			ginkgo.It("recycle the client only after the real end", func() {
+				gomega.Expect(response.Close()).To(gomega.Succeed())
+				gomega.Expect(client.index).To(gomega.Equal(len(client.protocols)))
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			})
+		})
+
+		ginkgo.When("the connection ends before the end", func() {
+			ginkgo.BeforeEach(func() {
+				client = &mockStringsClient{
+					protocols: [][]byte{[]byte("Daa"), []byte("aaDb")},
+				}
+				response = proxy.NewResponse(client, tmpProxy)
+			})
+
+			ginkgo.It("return the error and discard the client", func() {
+				err := response.Close()
+				gomega.Expect(errors.Is(err, proxy.ErrTruncatedResponse)).To(gomega.BeTrue())
+				gomega.Expect(errors.Is(err, io.ErrUnexpectedEOF)).To(gomega.BeTrue())
+				gomega.Expect(response.IsClosed()).To(gomega.Equal(true))
+				gomega.Expect(len(tmpProxy.clients)).To(gomega.Equal(0))
+			})
+		})
+	})
+	ginkgo.Describe("read a truncated response", ginkgo.Ordered, func() {
+		var response *proxy.Response
+		var client *mockStringsClient
+		var tmpProxy *mockProxy
+		ginkgo.BeforeAll(func() {
+			client = &mockStringsClient{
+				protocols: [][]byte{[]byte("DaaaaaaaaaDbbbb")},
+			}
+			tmpProxy = &mockProxy{
+				clients: make(map[server.Client]bool),
+			}
+			response = proxy.NewResponse(client, tmpProxy)
+		})
+
+		ginkgo.It("first time return the complete protocol", func() {
+			data, err := response.Read()
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(string(data)).To(gomega.Equal("Daaaaaaaaa"))
+		})
+
+		ginkgo.It("second time return truncated error with frames and bytes received", func() {
+			data, err := response.Read()
+			gomega.Expect(data).To(gomega.BeNil())
+			gomega.Expect(err).NotTo(gomega.Equal(io.EOF))
+			var truncated *proxy.TruncatedResponseError
+			gomega.Expect(errors.As(err, &truncated)).To(gomega.BeTrue())
+			gomega.Expect(truncated.Frames).To(gomega.Equal(1))
+			gomega.Expect(truncated.Bytes).To(gomega.Equal(len("DaaaaaaaaaDbbbb")))
+			gomega.Expect(truncated.Err).To(gomega.Equal(io.ErrUnexpectedEOF))
+
+			ginkgo.By("client is not recycled")
+			gomega.Expect(response.IsClosed()).To(gomega.Equal(true))
+			gomega.Expect(len(tmpProxy.clients)).To(gomega.Equal(0))
+		})
+	})
+	ginkgo.Describe("large frame", func() {
+		var tmpProxy *mockProxy
+
+		//readChunks 读取一个分块交付的帧，返回拼接后的帧和块数
+		readChunks := func(response *proxy.Response) ([]byte, int) {
+			var frame []byte
+			count := 0
+			for {
+				data, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				frame = append(frame, data...)
+				count++
+				if !response.Partial() {
+					return frame, count
+				}
+			}
+		}
+
+		ginkgo.BeforeEach(func() {
+			tmpProxy = &mockProxy{
+				clients: make(map[server.Client]bool),
+			}
+		})
+
+		ginkgo.When("frame is larger than the default max frame size", func() {
+			ginkgo.It("return max size exceeded error and discard the client", func() {
+				stream := append([]byte("D"), bytes.Repeat([]byte("a"), proxy.MaxProtocolLength)...)
+				client := &chunkClient{data: append(stream, 'Z'), size: 1024}
+				response := proxy.NewResponse(client, tmpProxy)
+				_, err := response.Read()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrMaxResponseProtocolSizeExceeded))
+				gomega.Expect(len(tmpProxy.clients)).To(gomega.Equal(0))
+			})
+		})
+
+		ginkgo.When("max frame size is configured larger", func() {
+			ginkgo.It("return the whole frame", func() {
+				frame := append([]byte("D"), bytes.Repeat([]byte("a"), proxy.MaxProtocolLength)...)
+				client := &chunkClient{data: append(append([]byte{}, frame...), 'Z'), size: 1024}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithMaxFrameSize(2*proxy.MaxProtocolLength))
+				data, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(data).To(gomega.Equal(frame))
+				_, err = response.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+			})
+		})
+
+		ginkgo.When("max frame size is smaller than a frame header", func() {
+			ginkgo.It("use the minimum size instead of reading nothing forever", func() {
+				client := &chunkClient{data: []byte("DaaaaaaaaaZ"), size: 16}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithMaxFrameSize(0))
+				_, err := response.Read()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrMaxResponseProtocolSizeExceeded))
+			})
+
+			ginkgo.It("stream length prefixed frames with the minimum size", func() {
+				frame := proxy.AppendLengthPrefixedFrame(nil, 'D', []byte("aaaaaaaaaa"))
+				stream := proxy.AppendLengthPrefixedFrame(append([]byte{}, frame...), 'Z', nil)
+				client := &chunkClient{data: stream, size: 16}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}),
+					proxy.WithMaxFrameSize(4), proxy.WithLargeFrameStreaming())
+
+				data, count := readChunks(response)
+				gomega.Expect(count).To(gomega.BeNumerically(">", 1))
+				gomega.Expect(data).To(gomega.Equal(frame))
+				_, err := response.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+			})
+		})
+
+		ginkgo.When("large frame streaming with delimiter codec", func() {
+			ginkgo.It("deliver the large frame in chunks and then the next frame", func() {
+				frame := append([]byte("D"), bytes.Repeat([]byte("a"), 40)...)
+				client := &chunkClient{data: append(append([]byte{}, frame...), "DbbZ"...), size: 16}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithMaxFrameSize(16), proxy.WithLargeFrameStreaming())
+
+				ginkgo.By("first chunk contains the frame head")
+				data, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(data)).To(gomega.Equal(string(frame[:16])))
+				gomega.Expect(response.Partial()).To(gomega.BeTrue())
+
+				ginkgo.By("continuation chunks until the final chunk")
+				rest, count := readChunks(response)
+				gomega.Expect(count).To(gomega.BeNumerically(">", 1))
+				gomega.Expect(string(rest)).To(gomega.Equal(string(frame[16:])))
+
+				ginkgo.By("next frame is normal")
+				data, err = response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(data)).To(gomega.Equal("Dbb"))
+				gomega.Expect(response.Partial()).To(gomega.BeFalse())
+				_, err = response.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			})
+		})
+
+		ginkgo.When("large frame streaming with length prefixed codec", func() {
+			ginkgo.It("deliver the large frame in chunks regardless of content", func() {
+				frame := proxy.AppendLengthPrefixedFrame(nil, 'D', bytes.Repeat([]byte("aDZ"), 20))
+				stream := proxy.AppendLengthPrefixedFrame(append([]byte{}, frame...), 'Z', nil)
+				client := &chunkClient{data: stream, size: 7}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}),
+					proxy.WithMaxFrameSize(16), proxy.WithLargeFrameStreaming())
+
+				data, count := readChunks(response)
+				gomega.Expect(count).To(gomega.BeNumerically(">", 1))
+				gomega.Expect(data).To(gomega.Equal(frame))
+				_, err := response.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			})
+
+			ginkgo.It("close drain the rest of chunks", func() {
+				frame := proxy.AppendLengthPrefixedFrame(nil, 'D', bytes.Repeat([]byte("Z"), 60))
+				stream := proxy.AppendLengthPrefixedFrame(append([]byte{}, frame...), 'Z', nil)
+				client := &chunkClient{data: stream, size: 16}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(proxy.LengthPrefixedCodec{}),
+					proxy.WithMaxFrameSize(16), proxy.WithLargeFrameStreaming())
+
+				_, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(response.Partial()).To(gomega.BeTrue())
+				gomega.Expect(response.Close()).To(gomega.Succeed())
+				gomega.Expect(len(client.data)).To(gomega.Equal(0))
+				gomega.Expect(tmpProxy.clients[client]).To(gomega.Equal(true))
+			})
+		})
+
+		ginkgo.When("large frame streaming with a codec not support chunks", func() {
+			ginkgo.It("return max size exceeded error", func() {
+				client := &chunkClient{data: []byte("+aaaaaaaaaaaaaaaaaaaaaaaaaaa\n.\n"), size: 16}
+				response := proxy.NewResponse(client, tmpProxy, proxy.WithCodec(lineCodec{}),
+					proxy.WithMaxFrameSize(16), proxy.WithLargeFrameStreaming())
+				_, err := response.Read()
+				gomega.Expect(err).To(gomega.Equal(proxy.ErrMaxResponseProtocolSizeExceeded))
+			})
+		})
+	})
 })
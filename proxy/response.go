@@ -1,45 +1,140 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"github.com/weenxin/simple-tcp-proxy/server"
 	"io"
+	"net"
 	"sync"
+	"time"
 )
 
 const (
-	//MaxProtocolLength 一个Protocol最大5120。一个response可以由多个protocol组成，所以假设还算合理
+	//MaxProtocolLength 默认一个Protocol最大5120，可以通过WithMaxFrameSize修改。一个response可以由多个protocol组成，所以假设还算合理
 	MaxProtocolLength = 5120
 )
 
+var (
+	ErrDrainTimeout       = errors.New("drain response timeout")
+	ErrDrainLimitExceeded = errors.New("drain response limit exceeded")
+	ErrTruncatedResponse  = errors.New("server response truncated")
+)
+
+//TruncatedResponseError 连接在读到`Z`之前就失败了，已经收到的数据是不完整的，可以用errors.Is(err, ErrTruncatedResponse)判断
+//io.EOF只代表真正读到了`Z`，连接被server端关闭时Err是io.ErrUnexpectedEOF
+type TruncatedResponseError struct {
+	//Err 底层读连接的错误
+	Err error
+	//Frames 已经返回给调用方的protocol个数
+	Frames int
+	//Bytes 已经从连接中收到的字节数
+	Bytes int
+}
+
+func (e *TruncatedResponseError) Error() string {
+	return fmt.Sprintf("%s after %d frames %d bytes: %s", ErrTruncatedResponse.Error(), e.Frames, e.Bytes, e.Err.Error())
+}
+
+func (e *TruncatedResponseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TruncatedResponseError) Is(target error) bool {
+	return target == ErrTruncatedResponse
+}
+
 //Response 代表一个request的返回，一个Response 由多个Protocol组成，也就是以`D`分割的多行
 type Response struct {
 	//server端连接
 	client server.Client
 	//父亲
 	parent Proxy
+	//配置
+	opts *options
 	//数据缓存
 	data []byte
 	//上一次接收的大小
 	preProtocolSize int
 	//是否已经被关闭
 	isClosed bool
+	//排队等待连接的时间
+	waitDuration time.Duration
+	//已经返回给调用方的protocol个数
+	frames int
+	//已经从连接中收到的字节数
+	received int
+	//最后一帧的copy，buffer归还之后也可以使用
+	trailer []byte
+	//正在分块交付一个放不进缓存的帧
+	chunking bool
+	//分块交付时这一帧还剩多少字节没有收到，由ChunkCodec维护
+	chunkRemaining int
+	//上一次Read返回的是一帧中的一块，后面还有
+	partial bool
+	//上一次Read返回的是一帧中的后续块，不是帧的开头
+	continued bool
+	//第一帧之前失败时用来重新发送请求，nil表示不重试
+	retry *retryState
+	//client已经因为重试被删除了，不能再删除一次
+	discarded bool
+	//Proxy的统计，NewResponse创建时为nil
+	stats *stats
+	//Proxy的metrics，NewResponse创建时为nil
+	metrics *metrics
+	//请求开始的时间，用来计算延迟
+	start time.Time
+	//是否已经收到了第一帧
+	firstFrame bool
+	//分块交付的超大帧已经交付的字节数
+	frameSize int
+	//请求的tracer
+	tracer Tracer
+	//请求的指纹，配置了WithLogger时才有
+	fingerprint string
+}
+
+//clientRemover ServerProxy删除连接时可以带上原因，用于统计
+type clientRemover interface {
+	removeClient(client server.Client, err error)
 }
 
 //降低垃圾回收频率，我们使用pool，每个P一个Pool，自动伸缩
-//理论情况下，有多少个最大连接数，就会有多少个缓存对象，所以内存应该是 MaxProtocolLength * maxConnection
-var dataPoll = sync.Pool{
-	New: func() any {
-		return make([]byte, 0, MaxProtocolLength)
-	},
+//理论情况下，有多少个最大连接数，就会有多少个缓存对象，所以内存应该是 maxFrameSize * maxConnection
+//不同的Proxy可以配置不同的帧大小，每种大小一个pool
+var dataPools sync.Map
+
+func getBuffer(size int) []byte {
+	pool, ok := dataPools.Load(size)
+	if !ok {
+		pool, _ = dataPools.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				return make([]byte, 0, size)
+			},
+		})
+	}
+	return pool.(*sync.Pool).Get().([]byte)[:0]
+}
+
+func putBuffer(data []byte) {
+	if pool, ok := dataPools.Load(cap(data)); ok {
+		pool.(*sync.Pool).Put(data[:0])
+	}
 }
 
 //NewResponse 新建一个response，后续可以基于此进行迭代了
-func NewResponse(client server.Client, parent Proxy) *Response {
+func NewResponse(client server.Client, parent Proxy, opts ...Option) *Response {
+	return newResponse(client, parent, newOptions(opts))
+}
+
+func newResponse(client server.Client, parent Proxy, opts *options) *Response {
 	return &Response{
 		client: client,
 		parent: parent,
+		opts:   opts,
 		//从pool中取得，复用缓存
-		data: dataPoll.Get().([]byte)[:0],
+		data:   getBuffer(opts.maxFrameSize),
+		tracer: NoopTracer{},
 	}
 }
 
@@ -48,6 +143,19 @@ func (r *Response) IsClosed() bool {
 	return r.isClosed
 }
 
+//Attempts 发送请求的次数，配置了WithRetry时可能大于1
+func (r *Response) Attempts() int {
+	if r.retry == nil {
+		return 1
+	}
+	return r.retry.attempts
+}
+
+//WaitDuration 通过RequestContext请求时，排队等待连接的时间
+func (r *Response) WaitDuration() time.Duration {
+	return r.waitDuration
+}
+
 //Read从缓存中读取数据
 //WARNING： 返回的数据是共享缓存的，不应该在上面做任何修改，如果需要修改数据，应该单独copy出来做修改
 func (r *Response) Read() ([]byte, error) {
@@ -55,74 +163,256 @@ func (r *Response) Read() ([]byte, error) {
 	if r.isClosed {
 		return nil, io.EOF
 	}
-	//复用缓存区，清空上一帧的缓存，可以做环形队列，但要处理接收异常；我们的策略是这样，效率也可以，只是需要copy下内存
-	if r.preProtocolSize > 0 {
-		copy(r.data[0:], r.data[r.preProtocolSize:])
-		r.data = r.data[0 : len(r.data)-r.preProtocolSize]
-		r.preProtocolSize = 0
+	protocol, err := r.nextProtocol()
+	//还没有返回过任何数据时可以换一个连接重试
+	for err != nil && r.retry != nil && r.frames == 0 && !r.partial && !r.continued {
+		var client server.Client
+		if client, err = r.resend(err); err != nil {
+			break
+		}
+		r.reset(client)
+		protocol, err = r.nextProtocol()
 	}
-	//如果TCP粘包导致了收到下一帧的数据
-	if len(r.data) > 0 {
-		//从数据中获取一个protocol
-		protocol, err := FormatProtocol(r.data)
-		if err != nil {
-			r.removeClient()
-			return nil, err
+	//读取失败或者格式不对，连接有问题，应该删除连接
+	if err != nil {
+		r.removeClient(err)
+		return nil, err
+	}
+	if !r.firstFrame {
+		r.firstFrame = true
+		r.metrics.firstFrameAfter(r.start)
+		r.tracer.Event(EventFirstFrame, 0, nil)
+	}
+	//分块交付的超大帧，只有最后一块算一帧
+	if r.partial || r.continued {
+		r.frameSize += len(protocol)
+		if !r.partial {
+			r.frames++
+			r.stats.frame()
+			r.metrics.frame(r.frameSize)
+			r.tracer.Event(EventFrame, r.frameSize, nil)
+			r.frameSize = 0
+		}
+		return protocol, nil
+	}
+	//是否是最后一帧啦
+	if r.opts.codec.IsEndFrame(protocol) {
+		r.trailer = append(r.trailer[:0], protocol...)
+		//回收连接
+		r.putClient()
+		return nil, io.EOF
+	}
+	r.frames++
+	r.stats.frame()
+	r.metrics.frame(len(protocol))
+	r.tracer.Event(EventFrame, len(protocol), nil)
+	//server端返回的错误，response还没有结束
+	if r.opts.codec.IsErrorFrame(protocol) {
+		return nil, &ServerError{Frame: append([]byte(nil), protocol...)}
+	}
+	return protocol, nil
+}
+
+//Trailer Read返回io.EOF之后，获得最后一帧的内容，比如`Z`；其他时候返回nil
+func (r *Response) Trailer() []byte {
+	return r.trailer
+}
+
+//Partial 打开了WithLargeFrameStreaming时，上一次Read返回的是不是一个超大帧中的一块并且后面还有；
+//一个超大帧的第一块包含帧头，最后一块返回false（最后一块可能是空的）
+func (r *Response) Partial() bool {
+	return r.partial
+}
+
+//nextProtocol 取得下一个protocol（包括最后的`Z`），先从缓存中取，不够再从连接读；Read和Close共用，不会回收或者删除连接
+//打开了WithLargeFrameStreaming时，放不进缓存的帧会分块返回，通过r.partial和r.continued标记
+func (r *Response) nextProtocol() ([]byte, error) {
+	r.continued = r.partial
+	for {
+		//复用缓存区，清空上一帧的缓存，可以做环形队列，但要处理接收异常；我们的策略是这样，效率也可以，只是需要copy下内存
+		if r.preProtocolSize > 0 {
+			copy(r.data[0:], r.data[r.preProtocolSize:])
+			r.data = r.data[0 : len(r.data)-r.preProtocolSize]
+			r.preProtocolSize = 0
 		}
-		//是否是最后一帧啦
-		if IsEndResponse(protocol) {
-			//回收连接
-			r.putClient()
-			return nil, io.EOF
+		//超大帧的后续块
+		if r.chunking && len(r.data) > 0 {
+			chunk, remaining, final := r.opts.codec.(ChunkCodec).NextChunk(r.data, r.chunkRemaining)
+			if final || len(chunk) > 0 {
+				r.chunking, r.partial, r.chunkRemaining = !final, !final, remaining
+				r.preProtocolSize = len(chunk)
+				return chunk, nil
+			}
 		}
-		//找到一个protocol
-		if protocol != nil {
-			r.preProtocolSize = len(protocol)
-			return protocol, nil
+		//如果TCP粘包导致了收到下一帧的数据
+		if !r.chunking && len(r.data) > 0 {
+			//从数据中获取一个protocol
+			protocol, err := r.opts.codec.SplitFrame(r.data)
+			if err != nil {
+				return nil, err
+			}
+			//找到一个protocol
+			if protocol != nil {
+				r.partial = false
+				r.preProtocolSize = len(protocol)
+				return protocol, nil
+			}
+			//缓存满了还不够一个protocol
+			if len(r.data) == r.opts.maxFrameSize {
+				return r.firstChunk()
+			}
 		}
+		//没有数据，就先读取数据
+		readSize, err := r.client.Read(r.data[len(r.data):r.opts.maxFrameSize])
+		r.received += readSize
+		r.stats.received(readSize)
+		//还没有读到`Z`连接就失败了，返回的数据是不完整的
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, &TruncatedResponseError{Err: err, Frames: r.frames, Bytes: r.received}
+		}
+		r.data = r.data[:len(r.data)+readSize]
+	}
+}
+
+//firstChunk 缓存满了还不够一帧，打开了WithLargeFrameStreaming并且codec支持时，把整个缓存作为第一块返回
+func (r *Response) firstChunk() ([]byte, error) {
+	codec, ok := r.opts.codec.(ChunkCodec)
+	if !r.opts.streamLargeFrames || !ok {
+		return nil, ErrMaxResponseProtocolSizeExceeded
 	}
-	//没有数据，就先读取数据
-	readSize, err := r.client.Read(r.data[len(r.data):MaxProtocolLength])
-	//读取失败，连接有问题，应该删除连接
+	remaining, err := codec.FirstChunk(r.data)
 	if err != nil {
-		r.removeClient()
 		return nil, err
 	}
-	r.data = r.data[:len(r.data)+readSize]
+	r.chunking, r.partial, r.chunkRemaining = true, true, remaining
+	r.preProtocolSize = len(r.data)
+	return r.data, nil
+}
 
-	return r.Read()
+//resend 丢弃失败的连接，按照重试策略重新发送请求；不重试时返回err
+func (r *Response) resend(err error) (server.Client, error) {
+	if !retryable(err) {
+		return nil, err
+	}
+	r.discard(err)
+	client, err := r.retry.send(err)
+	if err != nil {
+		return nil, err
+	}
+	r.retry.p.trackResponse(client, r)
+	return client, nil
 }
 
-func (r *Response) removeClient() {
-	//设置为空闲
+//reset 换了一个连接，丢弃之前收到的数据重新开始读
+func (r *Response) reset(client server.Client) {
+	r.client = client
+	r.discarded = false
+	r.data = r.data[:0]
+	r.preProtocolSize = 0
+	r.received = 0
+	r.chunking, r.chunkRemaining = false, 0
+}
+
+//discard 因为err删除连接，已经删除过的连接不再删除
+func (r *Response) discard(err error) {
+	if r.discarded {
+		return
+	}
+	r.discarded = true
+	r.tracer.Event(EventRemove, 0, err)
+	if remover, ok := r.parent.(clientRemover); ok {
+		remover.removeClient(r.client, err)
+		return
+	}
 	r.parent.RemoveClient(r.client)
+}
+
+func (r *Response) removeClient(err error) {
+	r.metrics.finish(err, r.start)
+	r.tracer.Event(EventEnd, 0, err)
+	//删除连接
+	r.discard(err)
 	//归还buffer
-	dataPoll.Put(r.data)
+	putBuffer(r.data)
 	r.isClosed = true
 }
 
 func (r *Response) putClient() {
+	r.metrics.finish(nil, r.start)
+	r.tracer.Event(EventEnd, 0, nil)
+	r.tracer.Event(EventRecycle, 0, nil)
 	//设置为空闲
 	r.parent.PutClient(r.client)
 	//归还buffer
-	dataPoll.Put(r.data)
+	putBuffer(r.data)
 	r.isClosed = true
 }
 
+//Close 关闭response，清空连接中未读的报文后回收连接
+//清空超时返回ErrDrainTimeout，超出清空的字节数返回ErrDrainLimitExceeded，这两种情况下连接都会被丢弃
 func (r *Response) Close() error {
 	if r.IsClosed() {
 		return nil
 	}
+	timeout := r.opts.drainTimeout
+	deadlineClient, canDeadline := r.client.(server.DeadlineClient)
+	if timeout > 0 && canDeadline {
+		if err := deadlineClient.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			r.removeClient(err)
+			return err
+		}
+	}
+	if err := r.drain(r.opts.drainLimit, timeout); err != nil {
+		r.removeClient(err)
+		return err
+	}
+	//连接要被复用，恢复读超时
+	if timeout > 0 && canDeadline {
+		if err := deadlineClient.SetReadDeadline(time.Time{}); err != nil {
+			r.removeClient(err)
+			return err
+		}
+	}
+	r.putClient()
+	return nil
+}
+
+//drain 按照和Read一样的方式逐个解析protocol（包括缓存中已经收到的数据），直到真正读到`Z`
+//不能只看每次读到的最后一个字节，`Z`可能已经在缓存中了，继续读会被挂住或者读到下一个请求的数据
+//limit是最多清空的字节数，timeout是最多清空的时间，为0时不限制
+func (r *Response) drain(limit int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	drained := 0
 	for {
-		// TODO Read增加超时时间，否则会被动hang在这里
-		length, err := r.client.Read(r.data[0:MaxProtocolLength])
+		protocol, err := r.nextProtocol()
 		if err != nil {
-			r.removeClient()
+			if isTimeout(err) {
+				return fmt.Errorf("%s[%w]", err.Error(), ErrDrainTimeout)
+			}
 			return err
 		}
-		if length > 0 && r.data[length-1] == 'Z' {
-			r.putClient()
+		if !r.partial && !r.continued && r.opts.codec.IsEndFrame(protocol) {
 			return nil
 		}
+		drained += len(protocol)
+		if limit > 0 && drained >= limit {
+			return ErrDrainLimitExceeded
+		}
+		//client不支持设置读超时时，只能在每次解析之后检查
+		if timeout > 0 && time.Now().After(deadline) {
+			return ErrDrainTimeout
+		}
+	}
+}
+
+//isTimeout 是否是读超时
+func isTimeout(err error) bool {
+	if errors.Is(err, server.ErrTimeout) {
+		return true
 	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
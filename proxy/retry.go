@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//defaultRetryBudgetBurst 重试预算默认的令牌上限
+const defaultRetryBudgetBurst = 10
+
+//RetryPolicy 请求失败后的重试策略，只在请求没有发送成功（建立连接失败、ErrBadConnection）
+//或者连接在返回第一帧之前失败时重试；已经有数据返回给调用方之后不会重试
+type RetryPolicy struct {
+	//MaxAttempts 最多尝试的次数，包括第一次，小于等于1表示不重试
+	MaxAttempts int
+	//Backoff 第一次重试之前的等待时间，之后每次翻倍
+	Backoff time.Duration
+	//MaxBackoff 等待时间的上限，0表示不限制
+	MaxBackoff time.Duration
+	//Jitter 0到1，等待时间随机减少的最大比例，避免大量请求同时重试
+	Jitter float64
+	//Budget 重试预算，每个请求存入Budget个令牌，每次重试消耗一个，令牌不够时不重试，避免server故障时重试放大流量；0表示不限制
+	Budget float64
+	//BudgetBurst 令牌的上限，也是初始的令牌数，0表示使用默认值10
+	BudgetBurst float64
+}
+
+//retryBudget 重试预算的令牌桶
+type retryBudget struct {
+	lock   sync.Mutex
+	tokens float64
+	ratio  float64
+	burst  float64
+}
+
+func newRetryBudget(policy *RetryPolicy) *retryBudget {
+	burst := policy.BudgetBurst
+	if burst <= 0 {
+		burst = defaultRetryBudgetBurst
+	}
+	return &retryBudget{tokens: burst, ratio: policy.Budget, burst: burst}
+}
+
+//deposit 每个请求存入令牌
+func (b *retryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens += b.ratio; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+//withdraw 重试之前取出一个令牌，没有配置预算时总是成功
+func (b *retryBudget) withdraw() bool {
+	if b.ratio <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//retryState 一个请求的重试状态，Response在第一帧之前失败时也用它重新发送请求
+type retryState struct {
+	p     *ServerProxy
+	ctx   context.Context
+	query []byte
+	wait  bool
+	//ctx中的tracer
+	tracer Tracer
+	//已经尝试的次数
+	attempts int
+	//排队等待连接的总时间
+	waited time.Duration
+}
+
+//send 占用连接并发送请求，失败时按照策略重试；lastErr不为nil时表示上一次尝试已经失败了
+func (s *retryState) send(lastErr error) (server.Client, error) {
+	for {
+		if lastErr != nil {
+			if !s.p.shouldRetry(lastErr, s.attempts) {
+				return nil, lastErr
+			}
+			if err := s.p.backoff(s.ctx, s.attempts); err != nil {
+				return nil, err
+			}
+		}
+		s.attempts++
+		client, waited, err := s.p.acquire(s.ctx, s.query, s.wait)
+		s.waited += waited
+		if err == nil {
+			span := s.tracer.StartSpan(SpanRequestWrite)
+			err = s.p.sendRequest(s.query, client)
+			span.End(err)
+			if err == nil {
+				return client, nil
+			}
+		}
+		lastErr = err
+	}
+}
+
+//retryable 请求没有发送成功，或者连接在返回第一帧之前失败
+func retryable(err error) bool {
+	return errors.Is(err, ErrBadConnection) || errors.Is(err, server.ErrConnectFailed) || errors.Is(err, ErrTruncatedResponse)
+}
+
+//shouldRetry 已经尝试了attempts次，失败的原因是err，是否还要重试
+func (p *ServerProxy) shouldRetry(err error, attempts int) bool {
+	policy := p.opts.retry
+	if policy == nil || attempts >= policy.MaxAttempts || !retryable(err) {
+		return false
+	}
+	return p.budget.withdraw()
+}
+
+//backoff 第attempts次重试之前等待，ctx被取消时返回ctx的错误
+func (p *ServerProxy) backoff(ctx context.Context, attempts int) error {
+	policy := p.opts.retry
+	d := policy.Backoff
+	for i := 1; i < attempts && (policy.MaxBackoff <= 0 || d < policy.MaxBackoff); i++ {
+		d *= 2
+	}
+	if policy.MaxBackoff > 0 && d > policy.MaxBackoff {
+		d = policy.MaxBackoff
+	}
+	if policy.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * policy.Jitter * float64(d))
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.opts.clock.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+var _ = ginkgo.Describe("Retry", func() {
+	var backend *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+	var policy proxy.RetryPolicy
+
+	ginkgo.BeforeEach(func() {
+		backend = &mockProxyServer{
+			response: [][]byte{[]byte("Daaaaaaaaa"), []byte("Z")},
+		}
+		clock = newFakeClock()
+		policy = proxy.RetryPolicy{MaxAttempts: 3}
+	})
+
+	ginkgo.JustBeforeEach(func() {
+		p = proxy.NewProxy(5, backend, proxy.WithRetry(policy), proxy.WithClock(clock))
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("request could not be sent", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badSend = 2
+		})
+
+		ginkgo.It("retry on new clients", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(response.Attempts()).To(gomega.Equal(3))
+			protocol, err := response.Read()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(string(protocol)).To(gomega.Equal("Daaaaaaaaa"))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(backend.clients[1].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("attempts are used up", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badSend = 3
+		})
+
+		ginkgo.It("return the last error", func() {
+			_, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(errors.Is(err, proxy.ErrBadConnection)).To(gomega.BeTrue())
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(3))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(0))
+		})
+	})
+
+	ginkgo.When("connect failed", func() {
+		ginkgo.BeforeEach(func() {
+			backend.failures = 1
+		})
+
+		ginkgo.It("retry to connect", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(response.Attempts()).To(gomega.Equal(2))
+		})
+	})
+
+	ginkgo.When("connection failed before the first frame", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badRead = 1
+		})
+
+		ginkgo.It("send the request again on a new client", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			protocol, err := response.Read()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(string(protocol)).To(gomega.Equal("Daaaaaaaaa"))
+			gomega.Expect(response.Attempts()).To(gomega.Equal(2))
+			readAll(response)
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+		})
+	})
+
+	ginkgo.When("every connection failed before the first frame", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badRead = 3
+		})
+
+		ginkgo.It("remove each client once when attempts are used up", func() {
+			recorder := proxy.NewTraceRecorder()
+			ctx := proxy.ContextWithTracer(context.Background(), recorder)
+			response, err := p.RequestContext(ctx, []byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(errors.Is(err, proxy.ErrTruncatedResponse)).To(gomega.BeTrue())
+			gomega.Expect(response.Attempts()).To(gomega.Equal(3))
+
+			var removes int
+			for _, name := range recorder.Names() {
+				if name == proxy.EventRemove {
+					removes++
+				}
+			}
+			gomega.Expect(removes).To(gomega.Equal(3))
+			names := recorder.Names()
+			gomega.Expect(names[len(names)-2:]).To(gomega.Equal([]string{proxy.EventRemove, proxy.EventEnd}))
+		})
+	})
+
+	ginkgo.When("connection failed after data was returned", func() {
+		ginkgo.BeforeEach(func() {
+			backend.response = [][]byte{[]byte("Daaaaaaaaa"), []byte("Dbbb")}
+		})
+
+		ginkgo.It("never retry", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(errors.Is(err, proxy.ErrTruncatedResponse)).To(gomega.BeTrue())
+			gomega.Expect(response.Attempts()).To(gomega.Equal(1))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("server response a bad protocol", func() {
+		ginkgo.BeforeEach(func() {
+			backend.response = [][]byte{[]byte("bad protocol")}
+		})
+
+		ginkgo.It("never retry", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("backoff is set", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badSend = 2
+			policy.Backoff = 100 * time.Millisecond
+		})
+
+		ginkgo.It("wait exponentially longer before each retry", func() {
+			result := make(chan error, 1)
+			go func() {
+				_, err := p.Request([]byte("Qfirst"))
+				result <- err
+			}()
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			clock.Advance(100 * time.Millisecond)
+			gomega.Eventually(backend.ClientCount).Should(gomega.Equal(2))
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			clock.Advance(100 * time.Millisecond)
+			gomega.Consistently(result, 20*time.Millisecond).ShouldNot(gomega.Receive())
+			clock.Advance(100 * time.Millisecond)
+			gomega.Eventually(result).Should(gomega.Receive(gomega.BeNil()))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(3))
+		})
+	})
+
+	ginkgo.When("retry budget is used up", func() {
+		ginkgo.BeforeEach(func() {
+			backend.badSend = 3
+			policy.MaxAttempts = 5
+			policy.Budget = 0.1
+			policy.BudgetBurst = 1
+		})
+
+		ginkgo.It("stop retrying", func() {
+			_, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(errors.Is(err, proxy.ErrBadConnection)).To(gomega.BeTrue())
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(2))
+		})
+	})
+})
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+//Stats 连接池的统计，和sql.DBStats类似，通过ServerProxy.Stats获得
+type Stats struct {
+	//MaxOpenConnections 最大连接数
+	MaxOpenConnections int
+
+	//OpenConnections 当前的连接数，包括正在使用的和空闲的
+	OpenConnections int
+	//InUse 正在使用的连接数
+	InUse int
+	//Idle 空闲的连接数
+	Idle int
+
+	//Dials 建立连接的次数，包括失败的
+	Dials int64
+	//DialFailures 建立连接失败的次数
+	DialFailures int64
+
+	//ClosedProtocolError 后端返回的报文格式错误被关闭的连接数
+	ClosedProtocolError int64
+	//ClosedReadError 读写失败被关闭的连接数
+	ClosedReadError int64
+	//ClosedIdleTimeout 空闲超过WithMaxIdleTime被关闭的连接数
+	ClosedIdleTimeout int64
+	//ClosedMaxLifetime 超过WithMaxLifetime被关闭的连接数
+	ClosedMaxLifetime int64
+	//ClosedMaxIdle 空闲连接超过WithMaxIdleConns被关闭的连接数
+	ClosedMaxIdle int64
+	//ClosedHookError Hooks的OnConnect或者OnCheckin返回错误被关闭的连接数
+	ClosedHookError int64
+	//ClosedOther 其他原因被关闭的连接数，比如健康检查或者校验失败、清空未读报文失败、后端被摘除、Proxy被关闭
+	ClosedOther int64
+
+	//WaitCount 排队等待连接的次数
+	WaitCount int64
+	//WaitDuration 排队等待连接的总时间
+	WaitDuration time.Duration
+
+	//Requests 成功发送的请求数，重试不重复计算
+	Requests int64
+	//Frames 返回给调用方的帧数，不包括结束帧
+	Frames int64
+	//Bytes 从后端收到的字节数，包括清空的未读报文
+	Bytes int64
+}
+
+//closeReason 连接被关闭的原因
+type closeReason int
+
+const (
+	closeOther closeReason = iota
+	closeProtocolError
+	closeReadError
+	closeIdleTimeout
+	closeMaxLifetime
+	closeMaxIdle
+	closeHookError
+)
+
+//closeReasonOf 连接因为err被删除的原因
+func closeReasonOf(err error) closeReason {
+	switch {
+	case errors.Is(err, ErrResponseProtocolFormat) || errors.Is(err, ErrMaxResponseProtocolSizeExceeded):
+		return closeProtocolError
+	case errors.Is(err, ErrTruncatedResponse) || errors.Is(err, ErrBadConnection):
+		return closeReadError
+	default:
+		return closeOther
+	}
+}
+
+//stats 累计的计数，原子操作，不需要持有锁；Response没有Proxy时为nil
+type stats struct {
+	dials        int64
+	dialFailures int64
+	closed       [closeHookError + 1]int64
+	waitCount    int64
+	waitDuration int64
+	requests     int64
+	frames       int64
+	bytes        int64
+}
+
+func (s *stats) dial(err error) {
+	atomic.AddInt64(&s.dials, 1)
+	if err != nil {
+		atomic.AddInt64(&s.dialFailures, 1)
+	}
+}
+
+func (s *stats) close(reason closeReason) {
+	atomic.AddInt64(&s.closed[reason], 1)
+}
+
+func (s *stats) wait(d time.Duration) {
+	atomic.AddInt64(&s.waitCount, 1)
+	atomic.AddInt64(&s.waitDuration, int64(d))
+}
+
+func (s *stats) request() {
+	atomic.AddInt64(&s.requests, 1)
+}
+
+func (s *stats) frame() {
+	if s != nil {
+		atomic.AddInt64(&s.frames, 1)
+	}
+}
+
+func (s *stats) received(n int) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.bytes, int64(n))
+	}
+}
+
+//Stats 连接池的统计快照，可以并发调用
+func (p *ServerProxy) Stats() Stats {
+	p.lock.Lock()
+	result := Stats{
+		MaxOpenConnections: p.maxClient,
+		OpenConnections:    len(p.clients),
+		InUse:              len(p.dependencies),
+		Idle:               p.idleCountLocked(),
+	}
+	p.lock.Unlock()
+
+	s := &p.stats
+	result.Dials = atomic.LoadInt64(&s.dials)
+	result.DialFailures = atomic.LoadInt64(&s.dialFailures)
+	result.ClosedProtocolError = atomic.LoadInt64(&s.closed[closeProtocolError])
+	result.ClosedReadError = atomic.LoadInt64(&s.closed[closeReadError])
+	result.ClosedIdleTimeout = atomic.LoadInt64(&s.closed[closeIdleTimeout])
+	result.ClosedMaxLifetime = atomic.LoadInt64(&s.closed[closeMaxLifetime])
+	result.ClosedMaxIdle = atomic.LoadInt64(&s.closed[closeMaxIdle])
+	result.ClosedHookError = atomic.LoadInt64(&s.closed[closeHookError])
+	result.ClosedOther = atomic.LoadInt64(&s.closed[closeOther])
+	result.WaitCount = atomic.LoadInt64(&s.waitCount)
+	result.WaitDuration = time.Duration(atomic.LoadInt64(&s.waitDuration))
+	result.Requests = atomic.LoadInt64(&s.requests)
+	result.Frames = atomic.LoadInt64(&s.frames)
+	result.Bytes = atomic.LoadInt64(&s.bytes)
+	return result
+}
@@ -0,0 +1,119 @@
+package proxy_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+var _ = ginkgo.Describe("Stats", func() {
+	var s *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: [][]byte{[]byte("Dabc"), []byte("Dde"), []byte("Z")}}
+		clock = newFakeClock()
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("count connections, requests, frames and bytes", func() {
+		p = proxy.NewProxy(2, s)
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		stats := p.Stats()
+		gomega.Expect(stats.MaxOpenConnections).To(gomega.Equal(2))
+		gomega.Expect(stats.OpenConnections).To(gomega.Equal(1))
+		gomega.Expect(stats.InUse).To(gomega.Equal(1))
+		gomega.Expect(stats.Idle).To(gomega.Equal(0))
+
+		readAll(response)
+		stats = p.Stats()
+		gomega.Expect(stats.InUse).To(gomega.Equal(0))
+		gomega.Expect(stats.Idle).To(gomega.Equal(1))
+		gomega.Expect(stats.Dials).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.DialFailures).To(gomega.Equal(int64(0)))
+		gomega.Expect(stats.Requests).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.Frames).To(gomega.Equal(int64(2)))
+		gomega.Expect(stats.Bytes).To(gomega.Equal(int64(8)))
+	})
+
+	ginkgo.It("count dial failures", func() {
+		s.failures = 1
+		p = proxy.NewProxy(2, s)
+		_, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).NotTo(gomega.BeNil())
+		stats := p.Stats()
+		gomega.Expect(stats.Dials).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.DialFailures).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.Requests).To(gomega.Equal(int64(0)))
+	})
+
+	ginkgo.It("count closed connections by reason", func() {
+		s.badRead = 1
+		s.response = [][]byte{[]byte("bad protocol")}
+		p = proxy.NewProxy(2, s)
+		for i := 0; i < 2; i++ {
+			response, err := p.Request([]byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(err).NotTo(gomega.BeNil())
+		}
+		stats := p.Stats()
+		gomega.Expect(stats.ClosedReadError).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.ClosedProtocolError).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.OpenConnections).To(gomega.Equal(0))
+	})
+
+	ginkgo.It("count connections closed by idle limits", func() {
+		p = proxy.NewProxy(2, s, proxy.WithMaxIdleTime(time.Minute), proxy.WithMaxIdleConns(1), proxy.WithClock(clock))
+		first, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		second, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(first)
+		readAll(second)
+		gomega.Expect(p.Stats().ClosedMaxIdle).To(gomega.Equal(int64(1)))
+
+		gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+		clock.Advance(time.Minute)
+		gomega.Eventually(func() int64 { return p.Stats().ClosedIdleTimeout }).Should(gomega.Equal(int64(1)))
+
+		ginkgo.By("removed by the caller")
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		response.Close()
+		p.RemoveClient(s.clients[2])
+		gomega.Expect(p.Stats().ClosedOther).To(gomega.Equal(int64(1)))
+	})
+
+	ginkgo.It("count waiting requests", func() {
+		s.response = repeatResponse("abc", 2)
+		p = proxy.NewProxy(1, s)
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+
+		waited := make(chan *proxy.Response, 1)
+		go func() {
+			response, err := p.RequestContext(context.Background(), []byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			waited <- response
+		}()
+		gomega.Consistently(func() int64 { return p.Stats().WaitCount }, 20*time.Millisecond).Should(gomega.Equal(int64(0)))
+
+		readAll(response)
+		var second *proxy.Response
+		gomega.Eventually(waited).Should(gomega.Receive(&second))
+		readAll(second)
+		stats := p.Stats()
+		gomega.Expect(stats.WaitCount).To(gomega.Equal(int64(1)))
+		gomega.Expect(stats.WaitDuration).To(gomega.BeNumerically(">=", 20*time.Millisecond))
+		gomega.Expect(stats.Requests).To(gomega.Equal(int64(2)))
+	})
+})
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//请求生命周期中的阶段（Span）和事件（Event）
+const (
+	//SpanPoolWait 连接数已满时排队等待连接，只有RequestContext会排队
+	SpanPoolWait = "pool_wait"
+	//SpanDial 新建到后端的连接
+	SpanDial = "dial"
+	//SpanRequestWrite 向后端发送请求
+	SpanRequestWrite = "request_write"
+	//EventFirstFrame 收到第一帧（也可能是结束帧）
+	EventFirstFrame = "first_frame"
+	//EventFrame 返回给调用方一帧，size是帧的大小
+	EventFrame = "frame"
+	//EventEnd response结束，err为nil表示读到了结束帧或者Close清空成功
+	EventEnd = "end"
+	//EventRecycle 连接被回收
+	EventRecycle = "recycle"
+	//EventRemove 连接有问题被删除，err是删除的原因
+	EventRemove = "remove"
+)
+
+//Span 一个有开始和结束的阶段
+type Span interface {
+	//End 阶段结束，err是阶段的结果
+	End(err error)
+}
+
+//Tracer 跟踪一个请求的生命周期，通过ContextWithTracer放进context，在RequestContext时使用
+//一个请求的Span和Event在调用Request和Response的goroutine中按顺序发生，不在Proxy的锁内调用，但不要阻塞
+type Tracer interface {
+	//StartSpan 开始一个阶段
+	StartSpan(name string) Span
+	//Event 发生了一个瞬时事件，size只有EventFrame才有意义
+	Event(name string, size int, err error)
+}
+
+type tracerKey struct{}
+
+//ContextWithTracer 返回带有tracer的context，通过RequestContext发出的请求会使用它
+func ContextWithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+//TracerFromContext 获得ctx中的tracer，没有时返回NoopTracer
+func TracerFromContext(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok && tracer != nil {
+		return tracer
+	}
+	return NoopTracer{}
+}
+
+//NoopTracer 什么都不做的Tracer，默认使用
+type NoopTracer struct{}
+
+//StartSpan 返回一个什么都不做的Span
+func (NoopTracer) StartSpan(string) Span {
+	return noopSpan{}
+}
+
+//Event 什么都不做
+func (NoopTracer) Event(string, int, error) {}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+//TraceRecord TraceRecorder记录的一个阶段或者事件
+type TraceRecord struct {
+	//Name 阶段或者事件的名字
+	Name string
+	//Span 是阶段还是事件
+	Span bool
+	//Start 阶段开始或者事件发生的时间
+	Start time.Time
+	//Duration 阶段持续的时间，事件为0
+	Duration time.Duration
+	//Size 帧的大小
+	Size int
+	//Err 阶段或者事件的错误
+	Err error
+}
+
+//TraceRecorder 在内存中记录所有阶段和事件的Tracer，可以用于测试；阶段在结束时才记录
+type TraceRecorder struct {
+	lock    sync.Mutex
+	records []TraceRecord
+}
+
+//NewTraceRecorder 新建一个TraceRecorder
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+//StartSpan 开始一个阶段，End时记录
+func (t *TraceRecorder) StartSpan(name string) Span {
+	return &recordedSpan{recorder: t, name: name, start: time.Now()}
+}
+
+//Event 记录一个事件
+func (t *TraceRecorder) Event(name string, size int, err error) {
+	t.record(TraceRecord{Name: name, Start: time.Now(), Size: size, Err: err})
+}
+
+//Records 已经记录的阶段和事件，按照记录的顺序
+func (t *TraceRecorder) Records() []TraceRecord {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]TraceRecord(nil), t.records...)
+}
+
+//Names 已经记录的阶段和事件的名字，按照记录的顺序
+func (t *TraceRecorder) Names() []string {
+	records := t.Records()
+	names := make([]string, 0, len(records))
+	for _, record := range records {
+		names = append(names, record.Name)
+	}
+	return names
+}
+
+func (t *TraceRecorder) record(record TraceRecord) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.records = append(t.records, record)
+}
+
+type recordedSpan struct {
+	recorder *TraceRecorder
+	name     string
+	start    time.Time
+}
+
+func (s *recordedSpan) End(err error) {
+	s.recorder.record(TraceRecord{Name: s.name, Span: true, Start: s.start, Duration: time.Since(s.start), Err: err})
+}
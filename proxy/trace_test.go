@@ -0,0 +1,109 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+//startedTracer 记录到TraceRecorder，同时通知开始了哪个阶段
+type startedTracer struct {
+	*proxy.TraceRecorder
+	started chan string
+}
+
+func (t startedTracer) StartSpan(name string) proxy.Span {
+	t.started <- name
+	return t.TraceRecorder.StartSpan(name)
+}
+
+var _ = ginkgo.Describe("Tracer", func() {
+	var s *mockProxyServer
+	var p *proxy.ServerProxy
+	var recorder *proxy.TraceRecorder
+	var ctx context.Context
+
+	ginkgo.BeforeEach(func() {
+		s = &mockProxyServer{response: [][]byte{[]byte("Dabc"), []byte("Dde"), []byte("Z")}}
+		p = proxy.NewProxy(1, s)
+		recorder = proxy.NewTraceRecorder()
+		ctx = proxy.ContextWithTracer(context.Background(), recorder)
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.It("use the no-op tracer by default", func() {
+		gomega.Expect(proxy.TracerFromContext(context.Background())).To(gomega.Equal(proxy.NoopTracer{}))
+		response, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+	})
+
+	ginkgo.It("trace the lifecycle of a request", func() {
+		response, err := p.RequestContext(ctx, []byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		readAll(response)
+		gomega.Expect(recorder.Names()).To(gomega.Equal([]string{
+			proxy.SpanDial, proxy.SpanRequestWrite, proxy.EventFirstFrame, proxy.EventFrame, proxy.EventFrame, proxy.EventEnd, proxy.EventRecycle,
+		}))
+		records := recorder.Records()
+		gomega.Expect(records[0].Span).To(gomega.BeTrue())
+		gomega.Expect(records[0].Err).To(gomega.BeNil())
+		gomega.Expect(records[2].Span).To(gomega.BeFalse())
+		gomega.Expect(records[3].Size).To(gomega.Equal(4))
+		gomega.Expect(records[4].Size).To(gomega.Equal(3))
+	})
+
+	ginkgo.It("trace waiting for a connection", func() {
+		s.response = repeatResponse("abc", 2)
+		first, err := p.Request([]byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+
+		waited := make(chan *proxy.Response, 1)
+		started := make(chan string, 10)
+		ctx = proxy.ContextWithTracer(context.Background(), startedTracer{TraceRecorder: recorder, started: started})
+		go func() {
+			defer ginkgo.GinkgoRecover()
+			response, err := p.RequestContext(ctx, []byte("Qxxxxx"))
+			gomega.Expect(err).To(gomega.BeNil())
+			waited <- response
+		}()
+		ginkgo.By("wait until the request is queued")
+		gomega.Eventually(started).Should(gomega.Receive(gomega.Equal(proxy.SpanPoolWait)))
+		time.Sleep(20 * time.Millisecond)
+		readAll(first)
+		var second *proxy.Response
+		gomega.Eventually(waited).Should(gomega.Receive(&second))
+		readAll(second)
+
+		gomega.Expect(recorder.Names()).To(gomega.Equal([]string{
+			proxy.SpanPoolWait, proxy.SpanRequestWrite, proxy.EventFirstFrame, proxy.EventFrame, proxy.EventEnd, proxy.EventRecycle,
+		}))
+		gomega.Expect(recorder.Records()[0].Duration).To(gomega.BeNumerically(">=", 20*time.Millisecond))
+	})
+
+	ginkgo.It("trace failed dials and removed connections", func() {
+		s.failures = 1
+		s.response = [][]byte{[]byte("bad protocol")}
+		_, err := p.RequestContext(ctx, []byte("Qxxxxx"))
+		gomega.Expect(errors.Is(err, server.ErrConnectFailed)).To(gomega.BeTrue())
+		response, err := p.RequestContext(ctx, []byte("Qxxxxx"))
+		gomega.Expect(err).To(gomega.BeNil())
+		_, err = response.Read()
+		gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+
+		gomega.Expect(recorder.Names()).To(gomega.Equal([]string{
+			proxy.SpanDial, proxy.SpanDial, proxy.SpanRequestWrite, proxy.EventEnd, proxy.EventRemove,
+		}))
+		records := recorder.Records()
+		gomega.Expect(errors.Is(records[0].Err, server.ErrConnectFailed)).To(gomega.BeTrue())
+		gomega.Expect(records[4].Err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+	})
+})
@@ -0,0 +1,127 @@
+package proxy_test
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+var _ = ginkgo.Describe("Validation", func() {
+	var backend *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		backend = &mockProxyServer{
+			response: [][]byte{
+				[]byte("Daaaaaaaaa"), []byte("Z"),
+				[]byte("Dpong"), []byte("Z"),
+				[]byte("Dbbbbbbbbb"), []byte("Z"),
+			},
+		}
+		clock = newFakeClock()
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("liveness check is used", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithValidation(proxy.ValidationConfig{}), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("reuse the client that is alive", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			_, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(backend.clients[0].checks).To(gomega.Equal(1))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(1))
+		})
+
+		ginkgo.It("never check a new client", func() {
+			_, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(backend.clients[0].checks).To(gomega.Equal(0))
+		})
+
+		ginkgo.It("replace the dead client transparently", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			backend.clients[0].aliveErr = server.ErrConnectionClosed
+
+			response, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			protocol, err := response.Read()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(string(protocol)).To(gomega.Equal("Daaaaaaaaa"))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(2))
+			gomega.Expect(backend.clients[0].isClosed()).To(gomega.BeTrue())
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("client was used within the window", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithValidation(proxy.ValidationConfig{Window: time.Minute}), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("skip the validation", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			backend.clients[0].aliveErr = server.ErrConnectionClosed
+
+			clock.Advance(30 * time.Second)
+			response, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Expect(backend.clients[0].checks).To(gomega.Equal(0))
+
+			ginkgo.By("validate after the window")
+			clock.Advance(time.Minute)
+			_, err = p.Request([]byte("Qthird"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(backend.clients[0].checks).To(gomega.Equal(1))
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(2))
+		})
+	})
+
+	ginkgo.When("probe query is used", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(2, backend, proxy.WithValidation(proxy.ValidationConfig{Query: []byte("Qping")}), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("read the probe response before sending the request", func() {
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			response, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			protocol, err := response.Read()
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(string(protocol)).To(gomega.Equal("Dbbbbbbbbb"))
+			gomega.Expect(backend.clients[0].checks).To(gomega.Equal(0))
+		})
+
+		ginkgo.It("replace the client when the probe failed", func() {
+			backend.response = backend.response[:2]
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+
+			_, err = p.Request([]byte("Qsecond"))
+			gomega.Expect(err).To(gomega.BeNil())
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(2))
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+})
@@ -0,0 +1,128 @@
+package proxy_test
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+)
+
+var _ = ginkgo.Describe("Min idle", func() {
+	var backend *mockProxyServer
+	var clock *fakeClock
+	var p *proxy.ServerProxy
+
+	ginkgo.BeforeEach(func() {
+		backend = &mockProxyServer{
+			response: [][]byte{
+				[]byte("Daaaaaaaaa"), []byte("Z"),
+				[]byte("Dbbbbbbbbb"), []byte("Z"),
+			},
+		}
+		clock = newFakeClock()
+	})
+
+	ginkgo.AfterEach(func() {
+		gomega.Expect(p.Close()).To(gomega.Succeed())
+	})
+
+	ginkgo.When("proxy is created", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(5, backend, proxy.WithMinIdle(2), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("dial min idle clients in background and reuse them", func() {
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(2))
+			gomega.Consistently(backend.ClientCount, 20*time.Millisecond).Should(gomega.Equal(2))
+
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			readAll(response)
+			gomega.Expect(backend.ClientCount()).To(gomega.Equal(2))
+		})
+	})
+
+	ginkgo.When("min idle is larger than max client", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(1, backend, proxy.WithMinIdle(3), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("never dial more than max client", func() {
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+			gomega.Consistently(backend.Attempts, 20*time.Millisecond).Should(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("a client is removed", func() {
+		ginkgo.BeforeEach(func() {
+			backend.response = [][]byte{[]byte("bad protocol")}
+			p = proxy.NewProxy(2, backend, proxy.WithMinIdle(1), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("dial a new client in background", func() {
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+			response, err := p.Request([]byte("Qfirst"))
+			gomega.Expect(err).To(gomega.BeNil())
+			_, err = response.Read()
+			gomega.Expect(err).To(gomega.Equal(proxy.ErrResponseProtocolFormat))
+
+			gomega.Eventually(backend.ClientCount).Should(gomega.Equal(2))
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+		})
+	})
+
+	ginkgo.When("connect keeps failing", func() {
+		ginkgo.BeforeEach(func() {
+			backend.failures = 3
+			p = proxy.NewProxy(2, backend, proxy.WithMinIdle(1), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("retry with exponential backoff", func() {
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			gomega.Expect(backend.Attempts()).To(gomega.Equal(1))
+
+			ginkgo.By("retry after 100ms")
+			clock.Advance(100 * time.Millisecond)
+			gomega.Eventually(backend.Attempts).Should(gomega.Equal(2))
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			ginkgo.By("retry after 200ms")
+			clock.Advance(100 * time.Millisecond)
+			gomega.Consistently(backend.Attempts, 20*time.Millisecond).Should(gomega.Equal(2))
+			clock.Advance(100 * time.Millisecond)
+			gomega.Eventually(backend.Attempts).Should(gomega.Equal(3))
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+
+			ginkgo.By("retry after 400ms and succeed")
+			clock.Advance(400 * time.Millisecond)
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+			gomega.Expect(backend.Attempts()).To(gomega.Equal(4))
+		})
+	})
+
+	ginkgo.When("idle time is exceeded", func() {
+		ginkgo.BeforeEach(func() {
+			p = proxy.NewProxy(5, backend, proxy.WithMinIdle(1), proxy.WithMaxIdleTime(time.Minute), proxy.WithClock(clock))
+		})
+
+		ginkgo.It("keep min idle clients open", func() {
+			responses := make([]*proxy.Response, 0, 2)
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+			for i := 0; i < 2; i++ {
+				response, err := p.Request([]byte("Qxxxxx"))
+				gomega.Expect(err).To(gomega.BeNil())
+				responses = append(responses, response)
+			}
+			for _, response := range responses {
+				readAll(response)
+			}
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(2))
+
+			gomega.Eventually(clock.Timers).Should(gomega.Equal(1))
+			clock.Advance(time.Minute)
+			gomega.Eventually(p.ClientCount).Should(gomega.Equal(1))
+			gomega.Consistently(p.ClientCount, 20*time.Millisecond).Should(gomega.Equal(1))
+		})
+	})
+})
@@ -1,5 +1,21 @@
 package server
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	//ErrConnectFailed 连接server失败，包括拒绝连接、连接超时等
+	ErrConnectFailed = errors.New("connect to server failed")
+	//ErrTimeout 读写server超时，连接状态未知，不应该再复用
+	ErrTimeout = errors.New("server io timeout")
+	//ErrConnectionClosed server端关闭了连接
+	ErrConnectionClosed = errors.New("server connection closed")
+	//ErrUnexpectedData 空闲连接上收到了不属于任何请求的数据，连接状态未知，不应该再复用
+	ErrUnexpectedData = errors.New("unexpected data on idle connection")
+)
+
 type Server interface {
 	Connect() (Client, error)
 }
@@ -9,3 +25,23 @@ type Client interface {
 	//Request 可以返一个io.Reader，简单起见，直接分两步吧
 	Request([]byte) error
 }
+
+//DeadlineClient 支持设置读超时的Client，Response.Close清空未读报文时用来避免被一直挂住
+type DeadlineClient interface {
+	Client
+	//SetReadDeadline 设置之后的读超时时间，零值表示取消
+	SetReadDeadline(t time.Time) error
+}
+
+//LivenessClient 不发送请求就可以检查连接是否可用的Client，Proxy从连接池取出空闲连接校验时使用
+type LivenessClient interface {
+	Client
+	//CheckAlive 不能阻塞太久，连接不可用时返回错误
+	CheckAlive() error
+}
+
+//CloseClient 支持关闭的Client，Proxy丢弃连接（读写失败、空闲超时等）时会关闭它；不实现时由Client自己负责释放资源
+type CloseClient interface {
+	Client
+	Close() error
+}
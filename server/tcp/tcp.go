@@ -0,0 +1,177 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/weenxin/simple-tcp-proxy/server"
+)
+
+const (
+	//DefaultConnectTimeout 默认连接超时时间
+	DefaultConnectTimeout = 3 * time.Second
+	//DefaultKeepAlive 默认TCP keepalive 探测间隔
+	DefaultKeepAlive = 30 * time.Second
+	//aliveCheckTimeout CheckAlive等待数据的时间
+	aliveCheckTimeout = time.Millisecond
+)
+
+//Config 连接后端server的配置
+type Config struct {
+	//Addr 后端地址，host:port
+	Addr string
+	//ConnectTimeout 建立连接的超时时间，0表示不超时
+	ConnectTimeout time.Duration
+	//KeepAlive TCP keepalive 探测间隔，0使用系统默认值，负数关闭keepalive
+	KeepAlive time.Duration
+	//NoDelay 是否设置TCP_NODELAY，protocol都比较小，一般需要打开
+	NoDelay bool
+	//ReadTimeout 每次读的超时时间，0表示不超时
+	ReadTimeout time.Duration
+	//WriteTimeout 每次写的超时时间，0表示不超时
+	WriteTimeout time.Duration
+}
+
+//DefaultConfig 返回一份默认配置
+func DefaultConfig(addr string) Config {
+	return Config{
+		Addr:           addr,
+		ConnectTimeout: DefaultConnectTimeout,
+		KeepAlive:      DefaultKeepAlive,
+		NoDelay:        true,
+	}
+}
+
+//Server 基于TCP的server.Server实现，每次Connect都会新建一个TCP连接
+type Server struct {
+	config Config
+	dialer net.Dialer
+}
+
+//NewServer 新建一个Server
+func NewServer(config Config) *Server {
+	return &Server{
+		config: config,
+		dialer: net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: config.KeepAlive,
+		},
+	}
+}
+
+//Addr 后端地址
+func (s *Server) Addr() string {
+	return s.config.Addr
+}
+
+//Connect 连接后端，失败时返回的错误可以用errors.Is(err, server.ErrConnectFailed)判断
+func (s *Server) Connect() (server.Client, error) {
+	conn, err := s.dialer.Dial("tcp", s.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s[%w]", err.Error(), server.ErrConnectFailed)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(s.config.NoDelay); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s[%w]", err.Error(), server.ErrConnectFailed)
+		}
+	}
+	return &Client{
+		conn:         conn,
+		readTimeout:  s.config.ReadTimeout,
+		writeTimeout: s.config.WriteTimeout,
+	}, nil
+}
+
+//Client 一个到后端的TCP连接
+type Client struct {
+	conn         net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	//通过SetReadDeadline设置的读超时，优先于readTimeout
+	readDeadline time.Time
+}
+
+//Read 读取server端的返回
+func (c *Client) Read(data []byte) (int, error) {
+	if !c.readDeadline.IsZero() {
+		if err := c.conn.SetReadDeadline(c.readDeadline); err != nil {
+			return 0, convertError(err)
+		}
+	} else if c.readTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, convertError(err)
+		}
+	}
+	n, err := c.conn.Read(data)
+	if err != nil {
+		return n, convertError(err)
+	}
+	return n, nil
+}
+
+//Request 发送请求，net.Conn保证要么全部写入，要么返回错误
+func (c *Client) Request(query []byte) error {
+	if c.writeTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return convertError(err)
+		}
+	}
+	if _, err := c.conn.Write(query); err != nil {
+		return convertError(err)
+	}
+	return nil
+}
+
+//SetReadDeadline 设置之后所有读的超时时间，零值表示恢复使用ReadTimeout
+func (c *Client) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return convertError(err)
+	}
+	return nil
+}
+
+//CheckAlive 检查空闲连接是否还可用：server已经关闭了连接，或者连接中有不属于任何请求的数据都返回错误
+//连接正常时会等待aliveCheckTimeout
+func (c *Client) CheckAlive() error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout)); err != nil {
+		return convertError(err)
+	}
+	var buf [1]byte
+	n, err := c.conn.Read(buf[:])
+	//恢复读超时
+	if resetErr := c.conn.SetReadDeadline(c.readDeadline); resetErr != nil {
+		return convertError(resetErr)
+	}
+	if n > 0 {
+		return server.ErrUnexpectedData
+	}
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	return convertError(err)
+}
+
+//Close 关闭连接
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+//RemoteAddr 后端地址
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+//convertError 把socket错误转换为server包中定义的错误，方便proxy判断
+func convertError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%s[%w]", err.Error(), server.ErrTimeout)
+	}
+	//io.EOF、连接被重置、管道断开、连接已关闭等，连接都不可用了
+	return fmt.Errorf("%s[%w]", err.Error(), server.ErrConnectionClosed)
+}
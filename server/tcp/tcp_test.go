@@ -0,0 +1,218 @@
+package tcp_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/gomega"
+	"github.com/weenxin/simple-tcp-proxy/proxy"
+	"github.com/weenxin/simple-tcp-proxy/server"
+	"github.com/weenxin/simple-tcp-proxy/server/tcp"
+)
+
+//loopbackBackend 一个本地的Q/D/Z后端：
+//收到 Qclose 直接关闭连接；收到 Qslow 不回复；其他请求回复 D+请求内容 和 Z
+type loopbackBackend struct {
+	listener net.Listener
+}
+
+func newLoopbackBackend() *loopbackBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	b := &loopbackBackend{listener: listener}
+	go b.serve()
+	return b
+}
+
+func (b *loopbackBackend) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *loopbackBackend) close() {
+	b.listener.Close()
+}
+
+func (b *loopbackBackend) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *loopbackBackend) handle(conn net.Conn) {
+	defer conn.Close()
+	data := make([]byte, 1024)
+	for {
+		n, err := conn.Read(data)
+		if err != nil {
+			return
+		}
+		query := string(data[:n])
+		switch query {
+		case "Qclose":
+			return
+		case "Qslow":
+			continue
+		}
+		if _, err := conn.Write([]byte("D" + query[1:] + "Z")); err != nil {
+			return
+		}
+	}
+}
+
+var _ = ginkgo.Describe("Tcp", func() {
+	var backend *loopbackBackend
+	var s *tcp.Server
+
+	ginkgo.BeforeEach(func() {
+		backend = newLoopbackBackend()
+		config := tcp.DefaultConfig(backend.addr())
+		config.ReadTimeout = 200 * time.Millisecond
+		config.WriteTimeout = 200 * time.Millisecond
+		s = tcp.NewServer(config)
+	})
+
+	ginkgo.AfterEach(func() {
+		backend.close()
+	})
+
+	ginkgo.Describe("Connect", func() {
+		ginkgo.When("backend is listening", func() {
+			ginkgo.It("return a client and can request", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.Request([]byte("Qhello"))).To(gomega.Succeed())
+				data := make([]byte, 1024)
+				n, err := client.Read(data)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(data[:n])).To(gomega.Equal("DhelloZ"))
+			})
+		})
+
+		ginkgo.When("backend is not listening", func() {
+			ginkgo.It("return connect failed error", func() {
+				backend.close()
+				client, err := s.Connect()
+				gomega.Expect(client).To(gomega.BeNil())
+				gomega.Expect(errors.Is(err, server.ErrConnectFailed)).To(gomega.BeTrue())
+			})
+		})
+	})
+
+	ginkgo.Describe("Read", func() {
+		ginkgo.When("backend does not response in read timeout", func() {
+			ginkgo.It("return timeout error", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.Request([]byte("Qslow"))).To(gomega.Succeed())
+				_, err = client.Read(make([]byte, 1024))
+				gomega.Expect(errors.Is(err, server.ErrTimeout)).To(gomega.BeTrue())
+			})
+		})
+
+		ginkgo.When("read deadline is set", func() {
+			ginkgo.It("return timeout error at the deadline", func() {
+				client, err := tcp.NewServer(tcp.DefaultConfig(backend.addr())).Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				deadlineClient := client.(server.DeadlineClient)
+				gomega.Expect(deadlineClient.SetReadDeadline(time.Now().Add(50 * time.Millisecond))).To(gomega.Succeed())
+				gomega.Expect(client.Request([]byte("Qslow"))).To(gomega.Succeed())
+				_, err = client.Read(make([]byte, 1024))
+				gomega.Expect(errors.Is(err, server.ErrTimeout)).To(gomega.BeTrue())
+
+				ginkgo.By("reset the deadline")
+				gomega.Expect(deadlineClient.SetReadDeadline(time.Time{})).To(gomega.Succeed())
+				gomega.Expect(client.Request([]byte("Qhello"))).To(gomega.Succeed())
+				data := make([]byte, 1024)
+				n, err := client.Read(data)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(data[:n])).To(gomega.Equal("DhelloZ"))
+			})
+		})
+
+		ginkgo.When("backend close the connection", func() {
+			ginkgo.It("return connection closed error", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.Request([]byte("Qclose"))).To(gomega.Succeed())
+				_, err = client.Read(make([]byte, 1024))
+				gomega.Expect(errors.Is(err, server.ErrConnectionClosed)).To(gomega.BeTrue())
+			})
+		})
+	})
+
+	ginkgo.Describe("CheckAlive", func() {
+		ginkgo.When("the idle connection is normal", func() {
+			ginkgo.It("return nil and keep the read timeout", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.(*tcp.Client).CheckAlive()).To(gomega.Succeed())
+				gomega.Expect(client.Request([]byte("Qhello"))).To(gomega.Succeed())
+				n, err := client.Read(make([]byte, 1024))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(n).To(gomega.Equal(len("DhelloZ")))
+			})
+		})
+
+		ginkgo.When("backend closed the connection", func() {
+			ginkgo.It("return connection closed error", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.Request([]byte("Qclose"))).To(gomega.Succeed())
+				gomega.Eventually(func() error {
+					return client.(*tcp.Client).CheckAlive()
+				}).Should(gomega.MatchError(server.ErrConnectionClosed))
+			})
+		})
+
+		ginkgo.When("there is data not belonging to any request", func() {
+			ginkgo.It("return unexpected data error", func() {
+				client, err := s.Connect()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				defer client.(*tcp.Client).Close()
+
+				gomega.Expect(client.Request([]byte("Qhello"))).To(gomega.Succeed())
+				gomega.Eventually(func() error {
+					return client.(*tcp.Client).CheckAlive()
+				}).Should(gomega.Equal(server.ErrUnexpectedData))
+			})
+		})
+	})
+
+	ginkgo.Describe("work with proxy", func() {
+		ginkgo.It("proxy request through tcp backend and reuse the client", func() {
+			p := proxy.NewProxy(2, s)
+			for _, query := range []string{"Qfirst", "Qsecond"} {
+				response, err := p.Request([]byte(query))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+				protocol, err := response.Read()
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				gomega.Expect(string(protocol)).To(gomega.Equal("D" + query[1:]))
+
+				protocol, err = response.Read()
+				gomega.Expect(err).To(gomega.Equal(io.EOF))
+				gomega.Expect(protocol).To(gomega.BeNil())
+			}
+			gomega.Expect(p.ClientCount()).To(gomega.Equal(1))
+		})
+	})
+})